@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -19,11 +24,33 @@ var stack *gbd.Stack
 
 var version = "0.0.1"
 
+// noMask disables the masking of secrets in the output
+var noMask bool
+
+// imagesArchive is loaded before the stack is built
+var imagesArchive string
+
+// rebuild ignores the build cache
+var rebuild bool
+
+// stackID prefixes the container names, the stack keeps it across reloads
+var stackID string
+
+// reloads are requested by the supervision of the stack, when a restart changed values derived by other dependencies,
+// and by the 'r' key. They all run on the watcher goroutine.
+var reloads = make(chan struct{}, 1)
+
+// stackMu guards stack, which reloads replace while it is printed or torn down
+var stackMu sync.Mutex
+
 func main() {
 
 	var config string
 	var contextDir string
 	var dumpConfig bool
+	var outDir string
+	var keyFile string
+	var secretsFile string
 
 	var dryRun = &cobra.Command{
 		Use:   "dry-run {context path} {config file (*.yaml)}",
@@ -39,14 +66,118 @@ func main() {
 
 	dryRun.Flags().StringVarP(&contextDir, "context", "c", "", "context path")
 	dryRun.Flags().StringVarP(&config, "config", "f", "", "config file (*.yaml) from context path")
+	dryRun.Flags().BoolVar(&noMask, "no-mask", false, "print secrets unmasked (local debugging only)")
+	dryRun.Flags().StringVar(&imagesArchive, "images-archive", "", "images archive to load before the stack is built")
+	dryRun.Flags().BoolVar(&rebuild, "rebuild", false, "rebuild images even when their build is cached")
+	dryRun.Flags().StringVar(&stackID, "stack-id", "", "prefix of the container names (random by default)")
 
 	watchConfig.Flags().StringVarP(&contextDir, "context", "c", "", "context path")
 	watchConfig.Flags().StringVarP(&config, "config", "f", "", "config file (*.yaml) from context path")
 	watchConfig.Flags().BoolVarP(&dumpConfig, "dump", "d", false, "dump config file to context path")
+	watchConfig.Flags().BoolVar(&noMask, "no-mask", false, "print and dump secrets unmasked (local debugging only)")
+	watchConfig.Flags().StringVar(&imagesArchive, "images-archive", "", "images archive to load before the stack is built")
+	watchConfig.Flags().BoolVar(&rebuild, "rebuild", false, "rebuild images even when their build is cached")
+	watchConfig.Flags().StringVar(&stackID, "stack-id", "", "prefix of the container names (random by default)")
+
+	var exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export a config file for usage without gbd",
+	}
+
+	var exportCompose = &cobra.Command{
+		Use:   "compose {context path} {config file (*.yaml)}",
+		Short: "Export a config file to a docker-compose.yml",
+		Run:   exportStack,
+	}
+
+	var exportScript = &cobra.Command{
+		Use:   "script {context path} {config file (*.yaml)}",
+		Short: "Export a config file to a shell script using the docker CLI",
+		Run:   exportStack,
+	}
+
+	for _, c := range []*cobra.Command{exportCompose, exportScript} {
+		c.Flags().StringVarP(&contextDir, "context", "c", "", "context path")
+		c.Flags().StringVarP(&config, "config", "f", "", "config file (*.yaml) from context path")
+		c.Flags().StringVarP(&outDir, "output", "o", "gbd_export", "output directory")
+		exportCmd.AddCommand(c)
+	}
+
+	var secretsCmd = &cobra.Command{
+		Use:   "secrets",
+		Short: "Manage the encrypted secrets file of a stack",
+	}
+
+	var secretsKeygen = &cobra.Command{
+		Use:   "keygen",
+		Short: "Print a new key for a secrets file",
+		Run:   secretsKeygen,
+	}
+
+	var secretsSet = &cobra.Command{
+		Use:   "set {name}",
+		Short: "Set a secret read from stdin",
+		Args:  cobra.ExactArgs(1),
+		Run:   secretsSet,
+	}
+
+	var secretsList = &cobra.Command{
+		Use:   "list",
+		Short: "List the names of the secrets",
+		Run:   secretsList,
+	}
+
+	for _, c := range []*cobra.Command{secretsSet, secretsList} {
+		c.Flags().StringVarP(&secretsFile, "file", "f", "", "secrets file")
+		c.Flags().StringVarP(&keyFile, "key-file", "k", "", "key file, when "+gbd.SecretsKeyEnv+" is not set")
+		_ = c.MarkFlagRequired("file")
+		secretsCmd.AddCommand(c)
+	}
+	secretsCmd.AddCommand(secretsKeygen)
+
+	var imagesCmd = &cobra.Command{
+		Use:   "images",
+		Short: "Save and load the images of a stack for offline usage",
+	}
+
+	var imagesSave = &cobra.Command{
+		Use:   "save {context path} {config file (*.yaml)}",
+		Short: "Save the images a stack pulls to a tar archive",
+		Run:   imagesSave,
+	}
+	imagesSave.Flags().StringVarP(&contextDir, "context", "c", "", "context path")
+	imagesSave.Flags().StringVarP(&config, "config", "f", "", "config file (*.yaml) from context path")
+	imagesSave.Flags().StringVarP(&outDir, "output", "o", "gbd_images.tar", "archive file")
+
+	var imagesLoad = &cobra.Command{
+		Use:   "load {archive}",
+		Short: "Load the images of an archive written by 'gbd images save'",
+		Args:  cobra.ExactArgs(1),
+		Run:   imagesLoad,
+	}
+	imagesCmd.AddCommand(imagesSave)
+	imagesCmd.AddCommand(imagesLoad)
+
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the images cached by gbd builds",
+	}
+
+	var cachePrune = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the images cached by gbd builds",
+		Run:   cachePrune,
+	}
+	cachePrune.Flags().Bool("keep-latest", false, "keep the most recent image of every build")
+	cacheCmd.AddCommand(cachePrune)
 
 	var rootCmd = &cobra.Command{Use: "gbd", Version: version}
 	rootCmd.AddCommand(dryRun)
 	rootCmd.AddCommand(watchConfig)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(secretsCmd)
+	rootCmd.AddCommand(imagesCmd)
+	rootCmd.AddCommand(cacheCmd)
 
 	log.Printf("GBD - GoBrewDock %s\n", version)
 
@@ -78,7 +209,8 @@ func dryRun(cmd *cobra.Command, args []string) {
 }
 
 func watchConfig(cmd *cobra.Command, args []string) {
-	ctx, cancel := context.WithCancel(context.Background())
+	// interrupts tear the stack down, processes on the host are not removed by the reaper
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	contextDir, _ := cmd.Flags().GetString("context")
@@ -87,6 +219,7 @@ func watchConfig(cmd *cobra.Command, args []string) {
 
 	path := filepath.Join(contextDir, config)
 	stack = buildStack(ctx, path, dump)
+	superviseStack(ctx, stack)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -101,7 +234,7 @@ func watchConfig(cmd *cobra.Command, args []string) {
 	}
 	defer watcher.Close()
 
-	go waitForInput(ctx, cancel, path, dump)
+	go waitForInput(ctx, cancel)
 
 	go func() {
 		for {
@@ -112,11 +245,14 @@ func watchConfig(cmd *cobra.Command, args []string) {
 				}
 				if event.Op&fsnotify.Write == fsnotify.Write && event.Name == path {
 					log.Println("File Modified: ", event.Name)
-					err = handleReload(ctx, path, dump)
-					if err != nil {
+					if err := handleReload(ctx, path, dump); err != nil {
 						cancel()
 					}
 				}
+			case <-reloads:
+				if err := handleReload(ctx, path, dump); err != nil {
+					cancel()
+				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
@@ -130,64 +266,233 @@ func watchConfig(cmd *cobra.Command, args []string) {
 
 	<-ctx.Done()
 	log.Println("Shutting down...")
+	stackMu.Lock()
+	defer stackMu.Unlock()
 	if err := stack.Teardown(context.Background()); err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 }
 
+func exportStack(cmd *cobra.Command, args []string) {
+	contextDir, _ := cmd.Flags().GetString("context")
+	config, _ := cmd.Flags().GetString("config")
+	outDir, _ := cmd.Flags().GetString("output")
+
+	env, err := gbd.NewEnvFromConfig(filepath.Join(contextDir, config))
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	var unresolved []string
+	if cmd.Name() == "compose" {
+		unresolved, err = env.ExportCompose(outDir)
+	} else {
+		unresolved, err = env.ExportScript(outDir)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	for _, u := range unresolved {
+		log.Println("Unresolved:", u)
+	}
+	log.Println("Exported to", outDir)
+}
+
+func imagesSave(cmd *cobra.Command, args []string) {
+	contextDir, _ := cmd.Flags().GetString("context")
+	config, _ := cmd.Flags().GetString("config")
+	archive, _ := cmd.Flags().GetString("output")
+
+	env, err := gbd.NewEnvFromConfig(filepath.Join(contextDir, config))
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	built, err := env.SaveImages(context.Background(), archive)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	for _, image := range built {
+		log.Println("Not saved, built by gbd:", image)
+	}
+	log.Println("Saved to", archive)
+}
+
+func imagesLoad(cmd *cobra.Command, args []string) {
+	if err := gbd.LoadImages(context.Background(), args[0]); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	log.Println("Loaded", args[0])
+}
+
+func cachePrune(cmd *cobra.Command, args []string) {
+	keepLatest, _ := cmd.Flags().GetBool("keep-latest")
+
+	removed, err := gbd.PruneBuildCache(context.Background(), keepLatest)
+	for _, image := range removed {
+		log.Println("Removed:", image)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func secretsKeygen(cmd *cobra.Command, args []string) {
+	key, err := gbd.GenerateSecretsKey()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(key)
+}
+
+func secretsSet(cmd *cobra.Command, args []string) {
+	path, _ := cmd.Flags().GetString("file")
+	keyFile, _ := cmd.Flags().GetString("key-file")
+
+	key, err := gbd.SecretsKey(keyFile)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	secrets, err := gbd.ReadSecretsFile(path, key)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	value, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	secrets[args[0]] = strings.TrimRight(string(value), "\r\n")
+	if err := gbd.WriteSecretsFile(path, key, secrets); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	log.Println("Secret set:", args[0])
+}
+
+func secretsList(cmd *cobra.Command, args []string) {
+	path, _ := cmd.Flags().GetString("file")
+	keyFile, _ := cmd.Flags().GetString("key-file")
+
+	key, err := gbd.SecretsKey(keyFile)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	secrets, err := gbd.ReadSecretsFile(path, key)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
 func buildStack(ctx context.Context, path string, dump bool) *gbd.Stack {
 	env, err := gbd.NewEnvFromConfig(path)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+	env.NoMask = env.NoMask || noMask
+	env.Rebuild = rebuild
+	if stackID != "" {
+		env.StackID = stackID
+	}
+	if imagesArchive != "" {
+		env.ImagesArchive, _ = filepath.Abs(imagesArchive)
+	}
 
 	stack, err := env.Build(ctx, dump)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+	stackID = stack.ID()
+	log.Printf("Stack %s\n", stackID)
 	return stack
 }
 
 func handleReload(ctx context.Context, path string, dump bool) error {
+	stackMu.Lock()
+	defer stackMu.Unlock()
+	// the stack is being shut down
+	if ctx.Err() != nil {
+		return nil
+	}
 	log.Println("Reloading...")
 	if err := stack.Teardown(ctx); err != nil {
 		return err
 	}
 	time.Sleep(5 * time.Second)
+	// processes on the host are restarted with the rest of the stack
 	stack = buildStack(ctx, path, dump)
-	env, err := gbd.NewEnvFromConfig(path)
-	if err != nil {
-		return err
-	}
-	stack, err = env.Build(ctx, false)
-	if err != nil {
-		return err
-	}
+	superviseStack(ctx, stack)
 	log.Println("Reloaded")
 	return nil
 }
 
-func waitForInput(ctx context.Context, cancel context.CancelFunc, path string, dump bool) {
+// superviseStack reports the crashes and restarts of the containers of a stack until it is torn down.
+func superviseStack(ctx context.Context, s *gbd.Stack) {
+	go func() {
+		err := s.Supervise(ctx, func(ev gbd.SupervisorEvent) {
+			log.Println(ev)
+			for _, line := range ev.Logs {
+				log.Printf("  %s | %s\n", ev.Component, line)
+			}
+			if len(ev.Dependents) > 0 {
+				log.Printf("%s derive values from '%s', reloading\n", strings.Join(ev.Dependents, ", "), ev.Component)
+				requestReload()
+			}
+		})
+		if err != nil {
+			log.Println("Supervision:", err)
+		}
+	}()
+}
+
+// requestReload asks the watcher goroutine to reload the stack, a pending request covers later ones.
+func requestReload() {
+	select {
+	case reloads <- struct{}{}:
+	default:
+	}
+}
+
+func waitForInput(ctx context.Context, cancel context.CancelFunc) {
 	var keystroke string
 	for {
 		log.Printf("Press 'r' to reload, 'p' to print dev stack, 'q' to quit:\t")
 		fmt.Scanln(&keystroke)
 		switch keystroke {
 		case "r":
-			err := handleReload(ctx, path, dump)
-			if err != nil {
-				cancel()
-				return
-			}
+			requestReload()
 		case "q":
 			cancel()
 			return
 		case "p":
+			stackMu.Lock()
 			log.Printf("Containers: \n")
 			log.Print(string(stack.Print()))
+			stackMu.Unlock()
+		}
+		if ctx.Err() != nil {
+			return
 		}
 	}
 }
@@ -1,38 +1,162 @@
 package utils
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
-func InspectContainer(ctx context.Context, image, version string) ([]byte, error) {
+// FindRunningContainer returns the running container with the name, or the one with all the labels when name
+// is empty. Exactly one container must match.
+func FindRunningContainer(ctx context.Context, name string, labels map[string]string) (types.Container, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return types.Container{}, err
+	}
+	defer cli.Close()
+	f := filters.NewArgs(filters.Arg("status", "running"))
+	if name != "" {
+		f.Add("name", name)
+	}
+	for k, v := range labels {
+		f.Add("label", k+"="+v)
+	}
+	r, err := cli.ContainerList(ctx, types.ContainerListOptions{Filters: f})
+	if err != nil {
+		return types.Container{}, err
+	}
+	var found []types.Container
+	for _, c := range r {
+		// the name filter matches substrings of the names
+		if name == "" || slices.Contains(c.Names, "/"+name) {
+			found = append(found, c)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return types.Container{}, fmt.Errorf("no running container matches")
+	case 1:
+		return found[0], nil
+	}
+	return types.Container{}, fmt.Errorf("%d running containers match", len(found))
+}
+
+// ContainerEvents streams the events of the containers with all the labels until ctx is done, only the actions
+// given when there are any.
+func ContainerEvents(ctx context.Context, labels map[string]string, actions ...string) (<-chan events.Message, <-chan error, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, nil, err
+	}
+	f := filters.NewArgs(filters.Arg("type", string(events.ContainerEventType)))
+	for k, v := range labels {
+		f.Add("label", k+"="+v)
+	}
+	for _, a := range actions {
+		f.Add("event", a)
+	}
+	msgs, errs := cli.Events(ctx, types.EventsOptions{Filters: f})
+	go func() {
+		<-ctx.Done()
+		cli.Close()
+	}()
+	return msgs, errs, nil
+}
+
+// InspectContainerID returns the docker inspect JSON of the container with the ID.
+func InspectContainerID(ctx context.Context, id string) ([]byte, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
 	}
-	ctr, err := findContainer(image, version, cli)
+	defer cli.Close()
+	_, json, err := cli.ContainerInspectWithRaw(ctx, id, true)
+	return json, err
+}
+
+// ContainerLogs returns the stdout and stderr of a container, interleaved as they were written.
+func ContainerLogs(ctx context.Context, id string) ([]byte, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
 	}
-	_, json, err := cli.ContainerInspectWithRaw(ctx, ctr, true)
+	defer cli.Close()
+	info, err := cli.ContainerInspect(ctx, id)
 	if err != nil {
 		return nil, err
 	}
+	rc, err := cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// the output of containers without a TTY is multiplexed
+	if info.Config != nil && info.Config.Tty {
+		return io.ReadAll(rc)
+	}
+	var out bytes.Buffer
+	_, err = stdcopy.StdCopy(&out, &out, rc)
+	return out.Bytes(), err
+}
 
-	return json, nil
+// ContainerExec runs cmd in a container and returns its exit code and its multiplexed stdout and stderr.
+func ContainerExec(ctx context.Context, id string, cmd []string) (int, []byte, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cli.Close()
+	exec, err := cli.ContainerExecCreate(ctx, id, types.ExecConfig{Cmd: cmd, AttachStdout: true, AttachStderr: true})
+	if err != nil {
+		return 0, nil, err
+	}
+	hijack, err := cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer hijack.Close()
+	out, err := io.ReadAll(hijack.Reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	// the output ends when the command exits, its exit code is set shortly after
+	for {
+		r, err := cli.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !r.Running {
+			return r.ExitCode, out, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
-func findContainer(image, version string, cli *client.Client) (string, error) {
-	f2 := filters.NewArgs(filters.KeyValuePair{Key: "ancestor", Value: fmt.Sprintf("%s:%s", image, version)})
-	r, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true, Filters: f2})
+// ReadContainerFile returns the content of a file of a container, following symbolic links.
+func ReadContainerFile(ctx context.Context, id, path string) ([]byte, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return r[0].ID, nil
+	defer cli.Close()
+	return followContainerFile(ctx, cli, id, path)
 }
 
 func WaitForContainerToBeRemoved(ids ...string) {
@@ -68,3 +192,282 @@ func WaitForContainerToBeRemoved(ids ...string) {
 		exitFlag = true
 	}
 }
+
+// CopyFileFromImage reads a file of an image by copying it out of a container which is created but never started.
+// The image is pulled with the base64 encoded registry auth if it is not present locally.
+func CopyFileFromImage(ctx context.Context, image, auth, path string) ([]byte, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	exists, err := imageExists(ctx, cli, image)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := pullImage(ctx, cli, image, auth); err != nil {
+			return nil, err
+		}
+	}
+
+	// the entrypoint is never executed, it only satisfies images without a command
+	created, err := cli.ContainerCreate(ctx, &container.Config{Image: image, Entrypoint: []string{"gbd-extract"}}, nil, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+
+	b, err := followContainerFile(ctx, cli, created.ID, path)
+	if err != nil {
+		return nil, fmt.Errorf("image '%s': %w", image, err)
+	}
+	return b, nil
+}
+
+// ImageExists reports whether an image is present locally.
+func ImageExists(ctx context.Context, image string) (bool, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+	return imageExists(ctx, cli, image)
+}
+
+// NetworkGateway returns the gateway of a docker network, the address of the host as seen from its containers.
+func NetworkGateway(ctx context.Context, network string) (string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+	nw, err := cli.NetworkInspect(ctx, network, types.NetworkInspectOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, cfg := range nw.IPAM.Config {
+		if cfg.Gateway != "" {
+			return cfg.Gateway, nil
+		}
+	}
+	return "", fmt.Errorf("network '%s' has no gateway", network)
+}
+
+// InspectNetwork returns the docker network with the name or ID.
+func InspectNetwork(ctx context.Context, network string) (types.NetworkResource, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return types.NetworkResource{}, err
+	}
+	defer cli.Close()
+	return cli.NetworkInspect(ctx, network, types.NetworkInspectOptions{})
+}
+
+// PullImage pulls an image with the base64 encoded registry auth (empty for anonymous pulls) and waits for
+// the pull to complete.
+func PullImage(ctx context.Context, image, auth string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	return pullImage(ctx, cli, image, auth)
+}
+
+// SaveImages writes the images to w as a tar archive, the format of 'docker save'.
+func SaveImages(ctx context.Context, images []string, w io.Writer) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	rc, err := cli.ImageSave(ctx, images)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// LoadImages loads the images of a tar archive written by SaveImages or 'docker save'.
+func LoadImages(ctx context.Context, r io.Reader) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	resp, err := cli.ImageLoad(ctx, r, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// ArchiveImages returns the tagged images of a tar archive written by SaveImages or 'docker save', read from
+// its manifest.json.
+func ArchiveImages(r io.Reader) ([]string, error) {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no manifest.json in the archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Name != "manifest.json" {
+			continue
+		}
+		var manifest []struct {
+			RepoTags []string
+		}
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("manifest.json: %w", err)
+		}
+		var images []string
+		for _, m := range manifest {
+			images = append(images, m.RepoTags...)
+		}
+		return images, nil
+	}
+}
+
+func imageExists(ctx context.Context, cli *client.Client, image string) (bool, error) {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, image); err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func pullImage(ctx context.Context, cli *client.Client, image, auth string) error {
+	rc, err := cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+// RemoveImages removes image references, tags or IDs, and returns the ones removed. Removing a tag of an image
+// which has other tags only untags it. References which are already gone or still used by a container are skipped.
+func RemoveImages(ctx context.Context, refs ...string) ([]string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	var removed []string
+	for _, ref := range refs {
+		_, err := cli.ImageRemove(ctx, ref, types.ImageRemoveOptions{PruneChildren: true})
+		switch {
+		case err == nil:
+			removed = append(removed, ref)
+		case client.IsErrNotFound(err), errdefs.IsConflict(err):
+		default:
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// TagImage tags the image source as target.
+func TagImage(ctx context.Context, source, target string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	return cli.ImageTag(ctx, source, target)
+}
+
+// ListImages returns the local images which have the label.
+func ListImages(ctx context.Context, label string) ([]types.ImageSummary, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	return cli.ImageList(ctx, types.ImageListOptions{Filters: filters.NewArgs(filters.Arg("label", label))})
+}
+
+// DockerCLI runs the docker CLI with the extra environment env. The output is printed when printLog is set,
+// otherwise it is returned with the error of a failed command.
+func DockerCLI(ctx context.Context, printLog bool, env []string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = append(os.Environ(), env...)
+	var out bytes.Buffer
+	if printLog {
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	} else {
+		cmd.Stdout, cmd.Stderr = &out, &out
+	}
+	if err := cmd.Run(); err != nil {
+		if out.Len() > 0 {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(out.String()))
+		}
+		return err
+	}
+	return nil
+}
+
+// NormalizeImageName returns the fully qualified name of an image repository, as docker resolves it:
+// postgres is docker.io/library/postgres and bitnami/kafka docker.io/bitnami/kafka.
+func NormalizeImageName(name string) string {
+	first, rest, found := strings.Cut(name, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return name
+	}
+	if !found {
+		return "docker.io/library/" + name
+	}
+	return "docker.io/" + first + "/" + rest
+}
+
+// followContainerFile returns the content of a file of a container, following symbolic links.
+func followContainerFile(ctx context.Context, cli *client.Client, id, path string) ([]byte, error) {
+	for i := 0; i < 8; i++ {
+		b, link, err := readContainerFile(ctx, cli, id, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if link == "" {
+			return b, nil
+		}
+		if !strings.HasPrefix(link, "/") {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = link
+	}
+	return nil, fmt.Errorf("%s: too many levels of symbolic links", path)
+}
+
+// readContainerFile returns the content of a regular file, or the target of a symbolic link.
+func readContainerFile(ctx context.Context, cli *client.Client, id, path string) ([]byte, string, error) {
+	rc, _, err := cli.CopyFromContainer(ctx, id, path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, "", err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		return nil, hdr.Linkname, nil
+	case tar.TypeReg:
+		b, err := io.ReadAll(tr)
+		return b, "", err
+	}
+	return nil, "", fmt.Errorf("not a regular file")
+}
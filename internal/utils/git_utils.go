@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitHead returns the commit and the branch checked out in the git repository containing dir, read from its
+// .git directory without the git CLI. The branch is empty for a detached HEAD, both are empty outside a repository.
+func GitHead(dir string) (commit, branch string, err error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil || gitDir == "" {
+		return "", "", err
+	}
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+	ref, ok := strings.CutPrefix(strings.TrimSpace(string(head)), "ref: ")
+	if !ok {
+		return strings.TrimSpace(string(head)), "", nil
+	}
+	branch = strings.TrimPrefix(ref, "refs/heads/")
+	commit, err = resolveRef(gitDir, ref)
+	return commit, branch, err
+}
+
+// findGitDir returns the git directory of the repository containing dir, following the .git file of worktrees
+// and submodules.
+func findGitDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		p := filepath.Join(dir, ".git")
+		info, err := os.Stat(p)
+		if err == nil {
+			if info.IsDir() {
+				return p, nil
+			}
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return "", err
+			}
+			gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(b)), "gitdir: ")
+			if !ok {
+				return "", errors.New(p + ": not a gitdir file")
+			}
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return gitDir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// resolveRef reads a ref from its loose file or from packed-refs. Refs of worktrees are shared through commondir.
+func resolveRef(gitDir, ref string) (string, error) {
+	dirs := []string{gitDir}
+	if common, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		c := strings.TrimSpace(string(common))
+		if !filepath.IsAbs(c) {
+			c = filepath.Join(gitDir, c)
+		}
+		dirs = append(dirs, c)
+	}
+	for _, d := range dirs {
+		if b, err := os.ReadFile(filepath.Join(d, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+		f, err := os.Open(filepath.Join(d, "packed-refs"))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			sha, name, ok := strings.Cut(sc.Text(), " ")
+			if ok && name == ref {
+				f.Close()
+				return sha, nil
+			}
+		}
+		f.Close()
+	}
+	// a branch without commits
+	return "", nil
+}
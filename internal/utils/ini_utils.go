@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"strings"
+)
+
+// Ini is an INI file which is edited line by line, so that comments and the order of sections and keys are kept.
+// Keys are addressed by section and name, keys before the first section belong to the "" section.
+type Ini struct {
+	lines []iniLine
+}
+
+type iniLine struct {
+	raw     string
+	section string
+	key     string
+	value   string
+	prefix  string
+	entry   bool
+	header  bool
+}
+
+// ParseIni parses an INI file. Both '=' and ':' are accepted as separators, ';' and '#' start comments.
+func ParseIni(b []byte) *Ini {
+	ini := &Ini{}
+	section := ""
+	for _, raw := range splitLines(string(b)) {
+		trimmed := strings.TrimSpace(raw)
+		switch {
+		case trimmed == "" || trimmed[0] == ';' || trimmed[0] == '#':
+			ini.lines = append(ini.lines, iniLine{raw: raw, section: section})
+		case trimmed[0] == '[' && strings.HasSuffix(trimmed, "]"):
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			ini.lines = append(ini.lines, iniLine{raw: raw, section: section, header: true})
+		default:
+			sep := strings.IndexAny(raw, "=:")
+			if sep < 0 {
+				ini.lines = append(ini.lines, iniLine{raw: raw, section: section, key: trimmed, prefix: raw + " =", entry: true})
+				continue
+			}
+			prefix := raw[:sep+1]
+			if rest := raw[sep+1:]; len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t') {
+				prefix += rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+			}
+			ini.lines = append(ini.lines, iniLine{
+				raw:     raw,
+				section: section,
+				key:     strings.TrimSpace(raw[:sep]),
+				value:   strings.TrimSpace(raw[sep+1:]),
+				prefix:  prefix,
+				entry:   true,
+			})
+		}
+	}
+	return ini
+}
+
+// Get returns the value of key in section.
+func (ini *Ini) Get(section, key string) (string, bool) {
+	for _, l := range ini.lines {
+		if l.entry && l.section == section && l.key == key {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+// HasSection reports whether the section exists.
+func (ini *Ini) HasSection(section string) bool {
+	if section == "" {
+		return true
+	}
+	for _, l := range ini.lines {
+		if l.header && l.section == section {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the value of key in section. A missing key is added after the last entry of the section,
+// a missing section is added at the end of the file.
+func (ini *Ini) Set(section, key, value string) {
+	last := -1
+	for i := range ini.lines {
+		l := &ini.lines[i]
+		if l.section != section || (!l.entry && !l.header) {
+			continue
+		}
+		last = i
+		if l.entry && l.key == key {
+			l.value = value
+			l.raw = l.prefix + value
+			return
+		}
+	}
+	entry := iniLine{raw: key + " = " + value, section: section, key: key, value: value, prefix: key + " = ", entry: true}
+	if last < 0 && section != "" {
+		if n := len(ini.lines); n > 0 && strings.TrimSpace(ini.lines[n-1].raw) == "" {
+			ini.lines = ini.lines[:n-1]
+		}
+		if n := len(ini.lines); n > 0 {
+			// the blank separator belongs to the previous section
+			ini.lines = append(ini.lines, iniLine{section: ini.lines[n-1].section})
+		}
+		ini.lines = append(ini.lines, iniLine{raw: "[" + section + "]", section: section, header: true}, entry, iniLine{section: section})
+		return
+	}
+	ini.lines = append(ini.lines[:last+1], append([]iniLine{entry}, ini.lines[last+1:]...)...)
+}
+
+// Delete removes key from section, or the whole section when key is empty, and reports whether it existed.
+func (ini *Ini) Delete(section, key string) bool {
+	lines := ini.lines[:0]
+	found := false
+	for _, l := range ini.lines {
+		if l.section == section && section != "" && key == "" {
+			found = true
+			continue
+		}
+		if l.entry && l.section == section && l.key == key {
+			found = true
+			continue
+		}
+		lines = append(lines, l)
+	}
+	ini.lines = lines
+	return found
+}
+
+// Bytes renders the file.
+func (ini *Ini) Bytes() []byte {
+	raw := make([]string, len(ini.lines))
+	for i, l := range ini.lines {
+		raw[i] = l.raw
+	}
+	return []byte(strings.Join(raw, "\n"))
+}
@@ -2,8 +2,11 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/AsaiYusuke/jsonpath"
+	"gopkg.in/yaml.v3"
 )
 
 func FindValueInJson(source []byte, path string) (any, error) {
@@ -23,3 +26,87 @@ func FindValueInJson(source []byte, path string) (any, error) {
 
 	return jsonNode[0].(jsonpath.Accessor).Get(), nil
 }
+
+// MarshalJSONNode renders a node tree as json, keeping the key order of the document.
+// An empty indent produces compact output.
+func MarshalJSONNode(n *yaml.Node, indent string) ([]byte, error) {
+	var sb strings.Builder
+	if err := writeJSONNode(&sb, resolveNode(n), indent, 0); err != nil {
+		return nil, err
+	}
+	if indent != "" {
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String()), nil
+}
+
+func writeJSONNode(sb *strings.Builder, n *yaml.Node, indent string, depth int) error {
+	newline := func(d int) {
+		if indent != "" {
+			sb.WriteByte('\n')
+			sb.WriteString(strings.Repeat(indent, d))
+		}
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		if len(n.Content) == 0 {
+			sb.WriteString("{}")
+			return nil
+		}
+		sb.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			newline(depth + 1)
+			k, _ := json.Marshal(n.Content[i].Value)
+			sb.Write(k)
+			sb.WriteByte(':')
+			if indent != "" {
+				sb.WriteByte(' ')
+			}
+			if err := writeJSONNode(sb, resolveNode(n.Content[i+1]), indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		sb.WriteByte('}')
+	case yaml.SequenceNode:
+		if len(n.Content) == 0 {
+			sb.WriteString("[]")
+			return nil
+		}
+		sb.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			newline(depth + 1)
+			if err := writeJSONNode(sb, resolveNode(c), indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		sb.WriteByte(']')
+	case yaml.ScalarNode:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		if n.ShortTag() == "!!int" || n.ShortTag() == "!!float" {
+			// keep the original representation of numbers (precision, exponent notation)
+			if json.Valid([]byte(n.Value)) {
+				sb.WriteString(n.Value)
+				return nil
+			}
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		sb.Write(b)
+	default:
+		return fmt.Errorf("unsupported node of kind %d", n.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// KeySegment is a single step of a key path. It either selects a map key, a list index or,
+// when Wildcard is set, every value of a map or list.
+type KeySegment struct {
+	Key      string
+	Index    int
+	IsIndex  bool
+	Wildcard bool
+}
+
+func (s KeySegment) String() string {
+	switch {
+	case s.Wildcard:
+		return "*"
+	case s.IsIndex:
+		return fmt.Sprintf("[%d]", s.Index)
+	}
+	return s.Key
+}
+
+// ParseKeyPath parses a dot separated key path. Supported syntax:
+//   - db.host                     nested map keys
+//   - servers[0].host             list indexing
+//   - brokers.*.address           wildcard over every map value or list element (also brokers[*])
+//   - "spring.datasource.url"     quoted segments for keys containing dots (single or double quotes)
+//   - spring\.datasource\.url     escaped dots
+func ParseKeyPath(path string) ([]KeySegment, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty key path")
+	}
+	var segments []KeySegment
+	var sb strings.Builder
+	// pending is set when the current segment was quoted or escaped, so it is always taken literally
+	pending := false
+	flush := func() {
+		if sb.Len() == 0 && !pending {
+			return
+		}
+		if sb.String() == "*" && !pending {
+			segments = append(segments, KeySegment{Wildcard: true})
+		} else {
+			segments = append(segments, KeySegment{Key: sb.String()})
+		}
+		sb.Reset()
+		pending = false
+	}
+
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '\\':
+			if i+1 >= len(path) {
+				return nil, fmt.Errorf("key path '%s': trailing escape character", path)
+			}
+			i++
+			sb.WriteByte(path[i])
+			pending = true
+		case '"', '\'':
+			if sb.Len() > 0 {
+				return nil, fmt.Errorf("key path '%s': unexpected quote at position %d", path, i)
+			}
+			end := strings.IndexByte(path[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("key path '%s': unterminated quote at position %d", path, i)
+			}
+			sb.WriteString(path[i+1 : i+1+end])
+			pending = true
+			i += end + 1
+			if i+1 < len(path) && path[i+1] != '.' && path[i+1] != '[' {
+				return nil, fmt.Errorf("key path '%s': unexpected character after quoted key at position %d", path, i+1)
+			}
+		case '.':
+			if sb.Len() == 0 && !pending && (i == 0 || path[i-1] != ']') {
+				return nil, fmt.Errorf("key path '%s': empty key at position %d", path, i)
+			}
+			flush()
+		case '[':
+			flush()
+			end := strings.IndexByte(path[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("key path '%s': unterminated index at position %d", path, i)
+			}
+			idx := strings.TrimSpace(path[i+1 : i+1+end])
+			if idx == "*" {
+				segments = append(segments, KeySegment{Wildcard: true})
+			} else {
+				n, err := strconv.Atoi(idx)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("key path '%s': invalid index '%s'", path, idx)
+				}
+				segments = append(segments, KeySegment{Index: n, IsIndex: true})
+			}
+			i += end + 1
+			if i+1 < len(path) && path[i+1] != '.' && path[i+1] != '[' {
+				return nil, fmt.Errorf("key path '%s': unexpected character after index at position %d", path, i+1)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if path[len(path)-1] == '.' {
+		return nil, fmt.Errorf("key path '%s': trailing dot", path)
+	}
+	flush()
+	return segments, nil
+}
+
+func pathError(full, rest []KeySegment, msg string) error {
+	return fmt.Errorf("key '%s': segment '%s': %s", FormatKeyPath(full), rest[0], msg)
+}
+
+// FormatKeyPath renders segments back to the key path syntax accepted by ParseKeyPath.
+func FormatKeyPath(path []KeySegment) string {
+	var sb strings.Builder
+	for i, s := range path {
+		if s.IsIndex {
+			sb.WriteString(s.String())
+			continue
+		}
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		switch {
+		case s.Wildcard:
+			sb.WriteByte('*')
+		case s.Key == "":
+			sb.WriteString(`""`)
+		default:
+			for j := 0; j < len(s.Key); j++ {
+				if strings.IndexByte(".[]\"'\\*", s.Key[j]) >= 0 {
+					sb.WriteByte('\\')
+				}
+				sb.WriteByte(s.Key[j])
+			}
+		}
+	}
+	return sb.String()
+}
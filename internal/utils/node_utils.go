@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseNode parses a yaml (or json, being a subset of yaml) document into a node tree which keeps
+// comments, key order, anchors and scalar styles. An empty document yields an empty mapping.
+func ParseNode(b []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	clearMergeTags(&doc)
+	return &doc, nil
+}
+
+// clearMergeTags drops the resolved tag of merge keys, otherwise the encoder writes them back as '!!merge <<'.
+func clearMergeTags(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i < len(n.Content); i += 2 {
+			if n.Content[i].Tag == "!!merge" {
+				n.Content[i].Tag = ""
+			}
+		}
+	}
+	for _, c := range n.Content {
+		clearMergeTags(c)
+	}
+}
+
+// ValueNode converts a go value to a node that can be placed in a document with SetNodePath.
+func ValueNode(value any) (*yaml.Node, error) {
+	if n, ok := value.(*yaml.Node); ok {
+		return n, nil
+	}
+	var n yaml.Node
+	if err := n.Encode(value); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// DetectIndent returns the indentation width of the first indented line of a document, or def if there is none.
+func DetectIndent(b []byte, def int) int {
+	for _, line := range strings.Split(string(b), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == line || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		return len(line) - len(trimmed)
+	}
+	return def
+}
+
+// Operations supported by EditNodePath.
+const (
+	OpSet         = "set"
+	OpSetIfAbsent = "setIfAbsent"
+	OpDelete      = "delete"
+	OpAppend      = "append"
+	OpMerge       = "merge"
+)
+
+// SetNodePath sets value at the node(s) addressed by path, see EditNodePath. Only the addressed nodes are changed,
+// comments and anchors of the replaced nodes are kept.
+func SetNodePath(path []KeySegment, value *yaml.Node, root *yaml.Node, create bool) error {
+	return EditNodePath(path, OpSet, value, root, create)
+}
+
+// EditNodePath applies op with value at the node(s) addressed by path:
+//   - set          replaces the node, adding the key when it is missing
+//   - setIfAbsent  adds the key only when it is missing
+//   - delete       removes the key or list element, missing keys are ignored
+//   - append       adds value as the last element of a list
+//   - merge        deep merges a map into a map, keys of value win
+func EditNodePath(path []KeySegment, op string, value *yaml.Node, root *yaml.Node, create bool) error {
+	switch op {
+	case OpSet, OpSetIfAbsent, OpDelete, OpAppend, OpMerge:
+	default:
+		return fmt.Errorf("key '%s': unknown operation '%s'", FormatKeyPath(path), op)
+	}
+	if value == nil && op != OpDelete {
+		return fmt.Errorf("key '%s': operation '%s' requires a value", FormatKeyPath(path), op)
+	}
+	return editNodePath(path, path, op, value, root, create)
+}
+
+func editNodePath(full, path []KeySegment, op string, value *yaml.Node, node *yaml.Node, create bool) error {
+	node = resolveNode(node)
+	seg := path[0]
+	last := len(path) == 1
+	if last {
+		return editLeaf(full, path, op, value, node, create)
+	}
+
+	var children []*yaml.Node
+	switch node.Kind {
+	case yaml.MappingNode:
+		if seg.IsIndex {
+			return pathError(full, path, "cannot index a map")
+		}
+		if seg.Wildcard {
+			for i := 1; i < len(node.Content); i += 2 {
+				// merged maps belong to their anchor, not to this map
+				if node.Content[i-1].Value != "<<" {
+					children = append(children, node.Content[i])
+				}
+			}
+			break
+		}
+		child := ownValue(node, seg.Key)
+		if child == nil {
+			if !create {
+				return pathError(full, path, "key not found")
+			}
+			child = newContainerNode(path[1])
+			node.Content = append(node.Content, keyNode(seg.Key), child)
+		}
+		children = []*yaml.Node{child}
+	case yaml.SequenceNode:
+		if seg.Wildcard {
+			children = node.Content
+			break
+		}
+		if !seg.IsIndex {
+			return pathError(full, path, "cannot use a key on a list")
+		}
+		if seg.Index == len(node.Content) && create {
+			node.Content = append(node.Content, newContainerNode(path[1]))
+		}
+		if seg.Index >= len(node.Content) {
+			return pathError(full, path, fmt.Sprintf("index out of range (length %d)", len(node.Content)))
+		}
+		children = []*yaml.Node{node.Content[seg.Index]}
+	default:
+		return pathError(full, path, fmt.Sprintf("cannot traverse a %s", nodeKind(node)))
+	}
+
+	for _, child := range children {
+		if err := editNodePath(full, path[1:], op, value, child, create); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// editLeaf applies op on the entries of node selected by the last segment of the path.
+func editLeaf(full, path []KeySegment, op string, value *yaml.Node, node *yaml.Node, create bool) error {
+	seg := path[0]
+	switch node.Kind {
+	case yaml.MappingNode:
+		if seg.IsIndex {
+			return pathError(full, path, "cannot index a map")
+		}
+		for i := len(node.Content) - 2; i >= 0; i -= 2 {
+			key := node.Content[i].Value
+			if (!seg.Wildcard && key != seg.Key) || (seg.Wildcard && key == "<<") {
+				continue
+			}
+			if op == OpDelete {
+				node.Content = append(node.Content[:i], node.Content[i+2:]...)
+				continue
+			}
+			if err := editValue(full, path, op, value, node.Content[i+1], create); err != nil {
+				return err
+			}
+			if !seg.Wildcard {
+				return nil
+			}
+		}
+		if seg.Wildcard || op == OpDelete {
+			return nil
+		}
+		if merged := mappingValue(node, seg.Key); merged != nil {
+			switch op {
+			case OpSetIfAbsent:
+				return nil
+			case OpAppend, OpMerge:
+				return editValue(full, path, op, value, ownValue(node, seg.Key), create)
+			}
+		}
+		node.Content = append(node.Content, keyNode(seg.Key), newValueNode(op, value))
+		return nil
+	case yaml.SequenceNode:
+		if !seg.IsIndex && !seg.Wildcard {
+			return pathError(full, path, "cannot use a key on a list")
+		}
+		if seg.Wildcard {
+			if op == OpDelete {
+				node.Content = nil
+				return nil
+			}
+			for _, c := range node.Content {
+				if err := editValue(full, path, op, value, c, create); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if seg.Index < len(node.Content) {
+			if op == OpDelete {
+				node.Content = append(node.Content[:seg.Index], node.Content[seg.Index+1:]...)
+				return nil
+			}
+			return editValue(full, path, op, value, node.Content[seg.Index], create)
+		}
+		if seg.Index == len(node.Content) && (create || op == OpSetIfAbsent) && op != OpDelete && op != OpAppend {
+			node.Content = append(node.Content, newValueNode(op, value))
+			return nil
+		}
+		if op == OpDelete {
+			return nil
+		}
+		return pathError(full, path, fmt.Sprintf("index out of range (length %d)", len(node.Content)))
+	}
+	return pathError(full, path, fmt.Sprintf("cannot traverse a %s", nodeKind(node)))
+}
+
+// editValue applies op on an existing node.
+func editValue(full, path []KeySegment, op string, value *yaml.Node, target *yaml.Node, create bool) error {
+	switch op {
+	case OpSet:
+		assignNode(target, value)
+	case OpAppend:
+		seq := resolveNode(target)
+		if seq.Kind == yaml.ScalarNode && seq.ShortTag() == "!!null" {
+			assignNode(seq, &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"})
+		}
+		if seq.Kind != yaml.SequenceNode {
+			return pathError(full, path, fmt.Sprintf("cannot append to a %s", nodeKind(seq)))
+		}
+		seq.Content = append(seq.Content, value)
+	case OpMerge:
+		m := resolveNode(target)
+		if m.Kind == yaml.ScalarNode && m.ShortTag() == "!!null" {
+			assignNode(m, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+		}
+		if m.Kind != yaml.MappingNode || resolveNode(value).Kind != yaml.MappingNode {
+			return pathError(full, path, "merge requires a map on both sides")
+		}
+		mergeNodes(m, resolveNode(value))
+	}
+	return nil
+}
+
+// mergeNodes deep merges the mapping src into the mapping dst.
+func mergeNodes(dst, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, val := src.Content[i], src.Content[i+1]
+		existing := ownValue(dst, key.Value)
+		switch {
+		case existing == nil:
+			dst.Content = append(dst.Content, keyNode(key.Value), val)
+		case resolveNode(existing).Kind == yaml.MappingNode && resolveNode(val).Kind == yaml.MappingNode:
+			mergeNodes(resolveNode(existing), resolveNode(val))
+		default:
+			assignNode(existing, val)
+		}
+	}
+}
+
+func newValueNode(op string, value *yaml.Node) *yaml.Node {
+	if op == OpAppend {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{value}}
+	}
+	n := *value
+	return &n
+}
+
+func keyNode(key string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+}
+
+// resolveNode unwraps documents and follows aliases to the node holding the content.
+func resolveNode(n *yaml.Node) *yaml.Node {
+	for {
+		switch {
+		case n.Kind == yaml.DocumentNode && len(n.Content) > 0:
+			n = n.Content[0]
+		case n.Kind == yaml.AliasNode && n.Alias != nil:
+			n = n.Alias
+		default:
+			return n
+		}
+	}
+}
+
+// mappingValue returns the value of key in the mapping n, or in the maps merged into it with '<<' (an alias or a
+// list of aliases, the first one holding the key wins).
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value != "<<" {
+			continue
+		}
+		sources := []*yaml.Node{n.Content[i+1]}
+		if src := resolveNode(n.Content[i+1]); src.Kind == yaml.SequenceNode {
+			sources = src.Content
+		}
+		for _, src := range sources {
+			if src = resolveNode(src); src.Kind != yaml.MappingNode {
+				continue
+			}
+			if v := mappingValue(src, key); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// ownValue returns the value of key in the mapping n to be edited. A value merged with '<<' belongs to its
+// anchor, which other maps may merge as well, it is copied into n as an override first.
+func ownValue(n *yaml.Node, key string) *yaml.Node {
+	v := mappingValue(n, key)
+	if v == nil {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return v
+		}
+	}
+	v = copyNode(resolveNode(v))
+	n.Content = append(n.Content, keyNode(key), v)
+	return v
+}
+
+// copyNode deep copies a node without its anchors, aliases are kept.
+func copyNode(n *yaml.Node) *yaml.Node {
+	c := *n
+	c.Anchor = ""
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		if child.Kind == yaml.AliasNode {
+			c.Content[i] = child
+			continue
+		}
+		c.Content[i] = copyNode(child)
+	}
+	return &c
+}
+
+// assignNode replaces the content of dst with src, keeping the comments and anchor of dst.
+// A string replacing a string keeps the original quoting style unless quoting is required.
+func assignNode(dst, src *yaml.Node) {
+	style := src.Style
+	if style == 0 && dst.Kind == yaml.ScalarNode && src.Kind == yaml.ScalarNode && dst.ShortTag() == "!!str" && src.ShortTag() == "!!str" {
+		style = dst.Style
+	}
+	dst.Kind = src.Kind
+	dst.Tag = src.Tag
+	dst.Value = src.Value
+	dst.Style = style
+	dst.Content = src.Content
+	dst.Alias = src.Alias
+}
+
+func newContainerNode(next KeySegment) *yaml.Node {
+	if next.IsIndex {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+func nodeKind(n *yaml.Node) string {
+	if n.Kind == yaml.ScalarNode {
+		return "value of type " + n.ShortTag()
+	}
+	return fmt.Sprintf("node of kind %d", n.Kind)
+}
@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Properties is a java .properties or dotenv file which is edited line by line, so that comments,
+// blank lines and the order of the entries are kept.
+type Properties struct {
+	lines  []propertyLine
+	dotenv bool
+}
+
+// propertyLine is a logical line, possibly spanning several physical lines in a properties file.
+type propertyLine struct {
+	raw   string
+	key   string
+	value string
+	// prefix is the raw text up to the value (key, separator and for dotenv 'export ')
+	prefix string
+	quote  byte
+	entry  bool
+}
+
+// ParseProperties parses a java .properties file.
+func ParseProperties(b []byte) *Properties {
+	p := &Properties{}
+	physical := splitLines(string(b))
+	for i := 0; i < len(physical); i++ {
+		raw := physical[i]
+		logical := strings.TrimLeft(raw, " \t\f")
+		// a line ending with an odd number of backslashes continues on the next one
+		for endsWithContinuation(logical) && i+1 < len(physical) {
+			i++
+			raw += "\n" + physical[i]
+			logical = logical[:len(logical)-1] + strings.TrimLeft(physical[i], " \t\f")
+		}
+		if logical == "" || logical[0] == '#' || logical[0] == '!' {
+			p.lines = append(p.lines, propertyLine{raw: raw})
+			continue
+		}
+		key, sepEnd := splitPropertyKey(logical)
+		indent := raw[:len(raw)-len(strings.TrimLeft(raw, " \t\f"))]
+		prefix := indent + logical[:sepEnd]
+		if sepEnd == len(key) {
+			// a key without a value nor a separator
+			prefix += "="
+		}
+		p.lines = append(p.lines, propertyLine{
+			raw:    raw,
+			key:    unescapeProperty(key),
+			value:  unescapeProperty(logical[sepEnd:]),
+			prefix: prefix,
+			entry:  true,
+		})
+	}
+	return p
+}
+
+// ParseDotenv parses a .env file of KEY=VALUE lines, optionally prefixed with 'export' and quoted.
+func ParseDotenv(b []byte) *Properties {
+	p := &Properties{dotenv: true}
+	for _, raw := range splitLines(string(b)) {
+		trimmed := strings.TrimSpace(raw)
+		eq := strings.IndexByte(trimmed, '=')
+		if trimmed == "" || trimmed[0] == '#' || eq < 0 {
+			p.lines = append(p.lines, propertyLine{raw: raw})
+			continue
+		}
+		key := strings.TrimSpace(strings.TrimPrefix(trimmed[:eq], "export "))
+		value := strings.TrimSpace(trimmed[eq+1:])
+		var quote byte
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			quote = value[0]
+			value = value[1 : len(value)-1]
+			if quote == '"' {
+				value = strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\n`, "\n").Replace(value)
+			}
+		} else if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		p.lines = append(p.lines, propertyLine{
+			raw:    raw,
+			key:    key,
+			value:  value,
+			prefix: raw[:strings.IndexByte(raw, '=')+1],
+			quote:  quote,
+			entry:  true,
+		})
+	}
+	return p
+}
+
+// Get returns the value of the last entry for key.
+func (p *Properties) Get(key string) (string, bool) {
+	for i := len(p.lines) - 1; i >= 0; i-- {
+		if p.lines[i].entry && p.lines[i].key == key {
+			return p.lines[i].value, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces the value of every entry for key, or appends a new entry.
+func (p *Properties) Set(key, value string) {
+	found := false
+	for i := range p.lines {
+		l := &p.lines[i]
+		if !l.entry || l.key != key {
+			continue
+		}
+		found = true
+		l.value = value
+		l.raw = l.prefix + p.formatValue(value, l.quote)
+	}
+	if found {
+		return
+	}
+	l := propertyLine{key: key, value: value, entry: true}
+	if p.dotenv {
+		l.prefix = key + "="
+	} else {
+		l.prefix = escapeProperty(key, true) + "="
+	}
+	l.raw = l.prefix + p.formatValue(value, 0)
+	// keep a trailing newline of the file at the end
+	if n := len(p.lines); n > 0 && !p.lines[n-1].entry && p.lines[n-1].raw == "" {
+		p.lines = append(p.lines[:n-1], l, p.lines[n-1])
+		return
+	}
+	p.lines = append(p.lines, l)
+}
+
+// Delete removes every entry for key and reports whether there was one.
+func (p *Properties) Delete(key string) bool {
+	lines := p.lines[:0]
+	found := false
+	for _, l := range p.lines {
+		if l.entry && l.key == key {
+			found = true
+			continue
+		}
+		lines = append(lines, l)
+	}
+	p.lines = lines
+	return found
+}
+
+// Bytes renders the file.
+func (p *Properties) Bytes() []byte {
+	raw := make([]string, len(p.lines))
+	for i, l := range p.lines {
+		raw[i] = l.raw
+	}
+	return []byte(strings.Join(raw, "\n"))
+}
+
+func (p *Properties) formatValue(value string, quote byte) string {
+	if !p.dotenv {
+		return escapeProperty(value, false)
+	}
+	if quote == 0 && strings.ContainsAny(value, " \t#\"'\n\\$") {
+		quote = '"'
+	}
+	switch quote {
+	case '"':
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+	case '\'':
+		if !strings.Contains(value, "'") {
+			return "'" + value + "'"
+		}
+		return p.formatValue(value, '"')
+	}
+	return value
+}
+
+// splitPropertyKey returns the raw key and the offset where the value starts, after the separator.
+func splitPropertyKey(line string) (string, int) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '=' || line[i] == ':' || line[i] == ' ' || line[i] == '\t' || line[i] == '\f' {
+			end = i
+			break
+		}
+	}
+	i := end
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t' || line[i] == '\f') {
+		i++
+	}
+	if i < len(line) && (line[i] == '=' || line[i] == ':') {
+		i++
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t' || line[i] == '\f') {
+			i++
+		}
+	}
+	return line[:end], i
+}
+
+func endsWithContinuation(s string) bool {
+	n := 0
+	for i := len(s) - 1; i >= 0 && s[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+func unescapeProperty(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			sb.WriteByte('\t')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'u':
+			var r rune
+			if i+4 < len(s) {
+				if _, err := fmt.Sscanf(s[i+1:i+5], "%04x", &r); err == nil {
+					sb.WriteRune(r)
+					i += 4
+					continue
+				}
+			}
+			sb.WriteByte('u')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+func escapeProperty(s string, key bool) string {
+	var sb strings.Builder
+	for i, r := range s {
+		switch r {
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '=', ':', '#', '!', ' ':
+			// separators only need escaping in keys, comment markers and blanks only at the start
+			if key || i == 0 {
+				sb.WriteByte('\\')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func splitLines(s string) []string {
+	return strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+}
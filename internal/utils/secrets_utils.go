@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// secretsHeader prefixes an encrypted secrets file, the rest of the file is the base64 encoded nonce and ciphertext.
+const secretsHeader = "gbd-secrets:v1\n"
+
+// SecretsKeySize is the size of an AES-256 key.
+const SecretsKeySize = 32
+
+// ParseSecretsKey decodes a base64 encoded AES-256 key.
+func ParseSecretsKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("secrets key: %w", err)
+	}
+	if len(key) != SecretsKeySize {
+		return nil, fmt.Errorf("secrets key: expected %d bytes, got %d", SecretsKeySize, len(key))
+	}
+	return key, nil
+}
+
+// EncryptSecrets seals plaintext with AES-GCM under key.
+func EncryptSecrets(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(secretsHeader))
+	return []byte(secretsHeader + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// DecryptSecrets opens a file written by EncryptSecrets.
+func DecryptSecrets(key, data []byte) ([]byte, error) {
+	encoded, ok := bytes.CutPrefix(data, []byte(secretsHeader))
+	if !ok {
+		return nil, errors.New("not a gbd secrets file")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("secrets file is truncated")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(secretsHeader))
+	if err != nil {
+		return nil, errors.New("secrets file cannot be decrypted with the given key")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,28 +1,486 @@
 package utils
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
-func TestFindAndReplace(t *testing.T) {
-	cfg := map[string]any{
-		"db": map[string]any{
-			"host": "localhost",
-			"port": 5432,
-			"security": map[string]any{
-				"ssl": map[string]any{
-					"mode": "disable",
-					"tls":  true,
-				},
-			},
-		},
-	}
-
-	FindAndReplace([]string{"db", "host"}, "127.0.0.1", cfg)
-	FindAndReplace([]string{"db", "security", "ssl", "tls"}, false, cfg)
-
-	require.Equal(t, "127.0.0.1", cfg["db"].(map[string]any)["host"])
-	require.Equal(t, false, cfg["db"].(map[string]any)["security"].(map[string]any)["ssl"].(map[string]any)["tls"])
+func TestParseKeyPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []KeySegment
+	}{
+		{"db.host", []KeySegment{{Key: "db"}, {Key: "host"}}},
+		{"servers[0].host", []KeySegment{{Key: "servers"}, {Index: 0, IsIndex: true}, {Key: "host"}}},
+		{"brokers.*.address", []KeySegment{{Key: "brokers"}, {Wildcard: true}, {Key: "address"}}},
+		{"brokers[*]", []KeySegment{{Key: "brokers"}, {Wildcard: true}}},
+		{`"spring.datasource.url"`, []KeySegment{{Key: "spring.datasource.url"}}},
+		{`app.'a.b'[1]`, []KeySegment{{Key: "app"}, {Key: "a.b"}, {Index: 1, IsIndex: true}}},
+		{`spring\.datasource\.url`, []KeySegment{{Key: "spring.datasource.url"}}},
+		{`\*`, []KeySegment{{Key: "*"}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseKeyPath(tt.path)
+		require.NoError(t, err, tt.path)
+		require.Equal(t, tt.want, got, tt.path)
+		again, err := ParseKeyPath(FormatKeyPath(got))
+		require.NoError(t, err, tt.path)
+		require.Equal(t, tt.want, again, tt.path)
+	}
+
+	for _, bad := range []string{"", "a..b", ".a", "a.", "a[", "a[x]", "a[-1]", `"a`, `a"b"`, "a[0]b", `a\`} {
+		_, err := ParseKeyPath(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestSetNodePath(t *testing.T) {
+	root, err := ParseNode([]byte(`servers:
+  - host: a
+  - host: b
+brokers:
+  one: {address: x}
+  two: {address: y}
+spring.datasource.url: jdbc:old
+`))
+	require.NoError(t, err)
+
+	set := func(key string, value any, create bool) error {
+		path, err := ParseKeyPath(key)
+		require.NoError(t, err)
+		node, err := ValueNode(value)
+		require.NoError(t, err)
+		return SetNodePath(path, node, root, create)
+	}
+	decoded := func() map[string]any {
+		var cfg map[string]any
+		require.NoError(t, root.Decode(&cfg))
+		return cfg
+	}
+
+	require.NoError(t, set("servers[1].host", "c", false))
+	require.NoError(t, set("brokers.*.address", "z", false))
+	require.NoError(t, set(`"spring.datasource.url"`, "jdbc:new", false))
+	require.NoError(t, set("servers[*].port", 80, false))
+	cfg := decoded()
+	require.Equal(t, "c", cfg["servers"].([]any)[1].(map[string]any)["host"])
+	require.Equal(t, 80, cfg["servers"].([]any)[0].(map[string]any)["port"])
+	require.Equal(t, "z", cfg["brokers"].(map[string]any)["two"].(map[string]any)["address"])
+	require.Equal(t, "jdbc:new", cfg["spring.datasource.url"])
+
+	require.Error(t, set("missing.key", 1, false))
+	require.Error(t, set("servers[5].host", 1, false))
+	require.Error(t, set("servers.host", 1, false))
+	require.Error(t, set("brokers[0]", 1, false))
+	require.Error(t, set("servers[0].host.deeper", 1, false))
+
+	require.NoError(t, set("missing.key", 1, true))
+	require.NoError(t, set("servers[2].host", "d", true))
+	require.NoError(t, set("new.list[0].name", "n", true))
+	cfg = decoded()
+	require.Equal(t, 1, cfg["missing"].(map[string]any)["key"])
+	require.Len(t, cfg["servers"], 3)
+	require.Equal(t, "n", cfg["new"].(map[string]any)["list"].([]any)[0].(map[string]any)["name"])
+}
+
+func TestSetNodePathKeepsFormatting(t *testing.T) {
+	src := `# service config
+server:
+  address: ":80" # listen address
+defaults: &defaults
+  timeout: 5
+db:
+  <<: *defaults
+  host: localhost
+  replicas:
+    - host: a
+    - host: b
+`
+	root, err := ParseNode([]byte(src))
+	require.NoError(t, err)
+
+	set := func(key string, value any, create bool) error {
+		path, err := ParseKeyPath(key)
+		require.NoError(t, err)
+		node, err := ValueNode(value)
+		require.NoError(t, err)
+		return SetNodePath(path, node, root, create)
+	}
+	require.NoError(t, set("server.address", ":8080", false))
+	require.NoError(t, set("db.host", "pgtc", false))
+	require.NoError(t, set("db.replicas[*].port", 5432, false))
+	require.NoError(t, set("db.pool.size", 10, true))
+	require.Error(t, set("db.missing.key", 1, false))
+	require.Error(t, set("db.replicas[2].host", "c", false))
+
+	var buf strings.Builder
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(DetectIndent([]byte(src), 4))
+	require.NoError(t, enc.Encode(root))
+	require.Equal(t, `# service config
+server:
+  address: ":8080" # listen address
+defaults: &defaults
+  timeout: 5
+db:
+  <<: *defaults
+  host: pgtc
+  replicas:
+    - host: a
+      port: 5432
+    - host: b
+      port: 5432
+  pool:
+    size: 10
+`, buf.String())
+}
+
+func TestMarshalJSONNodeKeepsOrder(t *testing.T) {
+	src := `{"zeta": 1, "alpha": {"url": "http://old", "ratio": 1.50, "big": 12345678901234567890}, "list": [true, null, "x"]}`
+	root, err := ParseNode([]byte(src))
+	require.NoError(t, err)
+
+	path, err := ParseKeyPath("alpha.url")
+	require.NoError(t, err)
+	node, err := ValueNode("http://new")
+	require.NoError(t, err)
+	require.NoError(t, SetNodePath(path, node, root, false))
+
+	b, err := MarshalJSONNode(root, "")
+	require.NoError(t, err)
+	require.Equal(t, `{"zeta":1,"alpha":{"url":"http://new","ratio":1.50,"big":12345678901234567890},"list":[true,null,"x"]}`, string(b))
+
+	b, err = MarshalJSONNode(root, "  ")
+	require.NoError(t, err)
+	require.True(t, json.Valid(b))
+	require.Contains(t, string(b), "{\n  \"zeta\": 1,\n  \"alpha\": {\n    \"url\": \"http://new\",")
+}
+
+func TestEditNodePathOperations(t *testing.T) {
+	src := `tls:
+  enabled: true
+  cert: /certs/tls.crt
+brokers:
+  - kafka-1:9092
+features:
+  a: true
+  nested:
+    x: 1
+port: 80
+`
+	root, err := ParseNode([]byte(src))
+	require.NoError(t, err)
+
+	edit := func(key, op string, value any) error {
+		path, err := ParseKeyPath(key)
+		require.NoError(t, err)
+		var node *yaml.Node
+		if value != nil {
+			node, err = ValueNode(value)
+			require.NoError(t, err)
+		}
+		return EditNodePath(path, op, node, root, false)
+	}
+	require.NoError(t, edit("tls", OpDelete, nil))
+	require.NoError(t, edit("missing", OpDelete, nil))
+	require.NoError(t, edit("brokers", OpAppend, "kafka-2:9092"))
+	require.NoError(t, edit("topics", OpAppend, "events"))
+	require.NoError(t, edit("features", OpMerge, map[string]any{"b": false, "nested": map[string]any{"y": 2}}))
+	require.NoError(t, edit("port", OpSetIfAbsent, 8080))
+	require.NoError(t, edit("host", OpSetIfAbsent, "0.0.0.0"))
+	require.Error(t, edit("port", OpAppend, 1))
+	require.Error(t, edit("port", OpMerge, map[string]any{"a": 1}))
+	require.Error(t, edit("port", "replace", 1))
+	require.Error(t, edit("port", OpSet, nil))
+
+	var out map[string]any
+	require.NoError(t, root.Decode(&out))
+	require.Equal(t, map[string]any{
+		"brokers":  []any{"kafka-1:9092", "kafka-2:9092"},
+		"topics":   []any{"events"},
+		"features": map[string]any{"a": true, "b": false, "nested": map[string]any{"x": 1, "y": 2}},
+		"port":     80,
+		"host":     "0.0.0.0",
+	}, out)
+}
+
+func TestEditNodePathMergeKeys(t *testing.T) {
+	src := `defaults: &defaults
+  timeout: 5
+  pool:
+    size: 5
+logging: &logging
+  level: info
+db:
+  <<: *defaults
+  host: localhost
+cache:
+  <<: [*logging, *defaults]
+`
+	root, err := ParseNode([]byte(src))
+	require.NoError(t, err)
+
+	edit := func(key, op string, value any) error {
+		path, err := ParseKeyPath(key)
+		require.NoError(t, err)
+		node, err := ValueNode(value)
+		require.NoError(t, err)
+		return EditNodePath(path, op, node, root, false)
+	}
+	// merged keys exist, setIfAbsent keeps them
+	require.NoError(t, edit("db.timeout", OpSetIfAbsent, 30))
+	require.NoError(t, edit("cache.level", OpSetIfAbsent, "debug"))
+	require.NoError(t, edit("cache.pool.size", OpSetIfAbsent, 50))
+	// set overrides them in the map, the anchor is unchanged
+	require.NoError(t, edit("db.pool.size", OpSet, 10))
+	require.NoError(t, edit("cache.level", OpSet, "warn"))
+	require.Error(t, edit("db.pool.missing.key", OpSet, 1))
+
+	var out map[string]any
+	require.NoError(t, root.Decode(&out))
+	require.Equal(t, map[string]any{"timeout": 5, "pool": map[string]any{"size": 5}}, out["defaults"])
+	require.Equal(t, map[string]any{"timeout": 5, "host": "localhost", "pool": map[string]any{"size": 10}}, out["db"])
+	require.Equal(t, map[string]any{"timeout": 5, "level": "warn", "pool": map[string]any{"size": 5}}, out["cache"])
+
+	b, err := yaml.Marshal(root)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "db:\n    <<: *defaults\n    host: localhost\n    pool:\n        size: 10\n")
+}
+
+func TestCoerceValue(t *testing.T) {
+	tests := []struct {
+		value any
+		typ   string
+		want  any
+	}{
+		{"8080", "int", int64(8080)},
+		{float64(5432), "int", int64(5432)},
+		{"true", "bool", true},
+		{"1.5", "float", 1.5},
+		{8080, "string", "8080"},
+		{"x", "", "x"},
+	}
+	for _, tt := range tests {
+		got, err := CoerceValue(tt.value, tt.typ)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, got)
+	}
+	_, err := CoerceValue("s3cr3t-value", "int")
+	require.EqualError(t, err, "cannot convert the value to int")
+	_, err = CoerceValue("1", "duration")
+	require.Error(t, err)
+}
+
+func TestProperties(t *testing.T) {
+	src := "# datasource\nspring.datasource.url = jdbc:postgresql://localhost/db\nspring.datasource.password:secret\nmulti = a,\\\n    b\nempty\n"
+	p := ParseProperties([]byte(src))
+	v, ok := p.Get("multi")
+	require.True(t, ok)
+	require.Equal(t, "a,b", v)
+
+	p.Set("spring.datasource.url", "jdbc:postgresql://pgtc/db")
+	p.Set("empty", "x")
+	p.Set("new key", "a=b")
+	require.True(t, p.Delete("spring.datasource.password"))
+	require.Equal(t, "# datasource\nspring.datasource.url = jdbc:postgresql://pgtc/db\nmulti = a,\\\n    b\nempty=x\nnew\\ key=a=b\n", string(p.Bytes()))
+}
+
+func TestDotenv(t *testing.T) {
+	src := "# db\nexport DB_HOST=localhost\nDB_PASS=\"old pass\"\nDB_NAME=app # name\n"
+	p := ParseDotenv([]byte(src))
+	v, ok := p.Get("DB_NAME")
+	require.True(t, ok)
+	require.Equal(t, "app", v)
+
+	p.Set("DB_HOST", "pgtc")
+	p.Set("DB_PASS", `new "pass"`)
+	p.Set("DB_PORT", "5432")
+	require.Equal(t, "# db\nexport DB_HOST=pgtc\nDB_PASS=\"new \\\"pass\\\"\"\nDB_NAME=app # name\nDB_PORT=5432\n", string(p.Bytes()))
+}
+
+func TestIni(t *testing.T) {
+	src := "; global\nmode = dev\n\n[database]\nhost = localhost\nport: 5432\n\n[cache]\nttl = 10\n"
+	ini := ParseIni([]byte(src))
+	v, ok := ini.Get("database", "port")
+	require.True(t, ok)
+	require.Equal(t, "5432", v)
+
+	ini.Set("database", "host", "pgtc")
+	ini.Set("database", "user", "admin")
+	ini.Set("", "debug", "true")
+	ini.Set("server", "port", "8080")
+	require.True(t, ini.Delete("cache", ""))
+	require.Equal(t, "; global\nmode = dev\ndebug = true\n\n[database]\nhost = pgtc\nport: 5432\nuser = admin\n\n[server]\nport = 8080\n", string(ini.Bytes()))
+}
+
+func TestXmlDocument(t *testing.T) {
+	src := `<?xml version="1.0" encoding="UTF-8"?>
+<!-- logging -->
+<Configuration status="WARN">
+  <Appenders>
+    <Console name="Console" target="SYSTEM_OUT"/>
+  </Appenders>
+  <Loggers>
+    <Logger name="com.app" level="info"/>
+    <Logger name="org.hibernate" level="warn"/>
+    <Root level="error"><AppenderRef ref="Console"/></Root>
+  </Loggers>
+  <Url>http://old</Url>
+</Configuration>
+`
+	doc, err := ParseXml([]byte(src))
+	require.NoError(t, err)
+	require.Equal(t, src, string(doc.Bytes()))
+
+	v, ok, err := doc.Get("/Configuration/Loggers/Logger[@name='com.app']/@level")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "info", v)
+
+	require.NoError(t, doc.Set("/Configuration/Loggers/Logger[@name='com.app']/@level", "debug", false))
+	require.NoError(t, doc.Set("/Configuration/Url", "http://new?a=1&b=2", false))
+	require.NoError(t, doc.Set("/Configuration/Loggers/Logger[@name='org.kafka']/@level", "error", true))
+	require.Error(t, doc.Set("/Configuration/Missing/@x", "1", false))
+	found, err := doc.Delete("/Configuration/Loggers/Logger[2]")
+	require.NoError(t, err)
+	require.True(t, found)
+
+	require.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<!-- logging -->
+<Configuration status="WARN">
+  <Appenders>
+    <Console name="Console" target="SYSTEM_OUT"/>
+  </Appenders>
+  <Loggers>
+    <Logger name="com.app" level="debug"/>
+    <Root level="error"><AppenderRef ref="Console"/></Root>
+    <Logger name="org.kafka" level="error"/>
+  </Loggers>
+  <Url>http://new?a=1&amp;b=2</Url>
+</Configuration>
+`, string(doc.Bytes()))
+}
+
+func TestSecrets(t *testing.T) {
+	key, err := ParseSecretsKey("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=")
+	require.NoError(t, err)
+	_, err = ParseSecretsKey("c2hvcnQ=")
+	require.Error(t, err)
+
+	sealed, err := EncryptSecrets(key, []byte("db: s3cret\n"))
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "s3cret")
+
+	plaintext, err := DecryptSecrets(key, sealed)
+	require.NoError(t, err)
+	require.Equal(t, "db: s3cret\n", string(plaintext))
+
+	other := make([]byte, SecretsKeySize)
+	_, err = DecryptSecrets(other, sealed)
+	require.Error(t, err)
+	_, err = DecryptSecrets(key, []byte("db: s3cret\n"))
+	require.Error(t, err)
+}
+
+func TestHashBuildContext(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	write("Dockerfile", "FROM alpine\n")
+	write("main.go", "package main\n")
+	write(".dockerignore", "logs\n*.tmp\n")
+
+	hash, err := HashBuildContext(dir)
+	require.NoError(t, err)
+
+	// ignored files and modification times do not change the hash
+	write("logs/app.log", "started")
+	write("build.tmp", "x")
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "main.go"), time.Now(), time.Now().Add(time.Hour)))
+	same, err := HashBuildContext(dir)
+	require.NoError(t, err)
+	require.Equal(t, hash, same)
+
+	other, err := HashBuildContext(dir, "arg VERSION=2")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+
+	write("main.go", "package main\n\nfunc main() {}\n")
+	changed, err := HashBuildContext(dir)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, changed)
+}
+
+func TestGitHead(t *testing.T) {
+	const sha = "3f786850e387550fdab836ed7e6dc881de23001b"
+	repo := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(repo, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, name), []byte(content), 0644))
+	}
+	write(".git/HEAD", "ref: refs/heads/feature/x\n")
+	write(".git/refs/heads/feature/x", sha+"\n")
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "services", "api"), 0755))
+
+	commit, branch, err := GitHead(filepath.Join(repo, "services", "api"))
+	require.NoError(t, err)
+	require.Equal(t, sha, commit)
+	require.Equal(t, "feature/x", branch)
+
+	// packed refs
+	require.NoError(t, os.Remove(filepath.Join(repo, ".git", "refs", "heads", "feature", "x")))
+	write(".git/packed-refs", "# pack-refs with: peeled fully-peeled sorted\n"+sha+" refs/heads/feature/x\n")
+	commit, _, err = GitHead(repo)
+	require.NoError(t, err)
+	require.Equal(t, sha, commit)
+
+	// worktrees point to their git dir, which shares the refs of the repository
+	write(".git/worktrees/wt/HEAD", "ref: refs/heads/feature/x\n")
+	write(".git/worktrees/wt/commondir", "../..\n")
+	write("wt/.git", "gitdir: "+filepath.Join(repo, ".git", "worktrees", "wt")+"\n")
+	commit, branch, err = GitHead(filepath.Join(repo, "wt"))
+	require.NoError(t, err)
+	require.Equal(t, sha, commit)
+	require.Equal(t, "feature/x", branch)
+
+	// detached HEAD
+	write(".git/HEAD", sha+"\n")
+	commit, branch, err = GitHead(repo)
+	require.NoError(t, err)
+	require.Equal(t, sha, commit)
+	require.Empty(t, branch)
+}
+
+func TestArchiveImages(t *testing.T) {
+	archive := func(files map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, body := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}))
+			_, err := tw.Write([]byte(body))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		return &buf
+	}
+
+	images, err := ArchiveImages(archive(map[string]string{
+		"manifest.json": `[{"Config":"a.json","RepoTags":["postgres:16"]},{"Config":"b.json","RepoTags":["redis:7","redis:latest"]}]`,
+	}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"postgres:16", "redis:7", "redis:latest"}, images)
+
+	_, err = ArchiveImages(archive(map[string]string{"index.json": "{}"}))
+	require.EqualError(t, err, "no manifest.json in the archive")
 }
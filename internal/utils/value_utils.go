@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CoerceValue converts v to the named type (string, int, float, bool). An empty type leaves v unchanged.
+// Errors do not contain v, which may be a secret.
+func CoerceValue(v any, typ string) (any, error) {
+	if typ == "" {
+		return v, nil
+	}
+	s := strings.TrimSpace(fmt.Sprint(v))
+	switch typ {
+	case "string", "str":
+		return fmt.Sprint(v), nil
+	case "int":
+		if f, ok := v.(float64); ok && f == float64(int64(f)) {
+			return int64(f), nil
+		}
+		i, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert the value to int")
+		}
+		return i, nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert the value to float")
+		}
+		return f, nil
+	case "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert the value to bool")
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown type '%s'", typ)
+}
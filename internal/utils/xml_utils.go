@@ -0,0 +1,427 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// XmlDocument is an xml file which keeps the raw text of every token that was not edited,
+// so that comments, whitespace, namespaces and attribute order survive a rewrite.
+type XmlDocument struct {
+	root *xmlNode
+}
+
+type xmlNode struct {
+	// raw is the original text of the token, for elements only the start tag
+	raw      string
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	element  bool
+	text     bool
+	// selfClosing elements have no end tag in the original file
+	selfClosing bool
+	endRaw      string
+	dirty       bool
+}
+
+// xmlStep is a step of an xml path: an element name with an optional position (1 based, as in XPath)
+// or attribute predicate, or a final attribute selection.
+type xmlStep struct {
+	name      string
+	position  int
+	predAttr  string
+	predValue string
+	attr      string
+}
+
+// ParseXml parses an xml document.
+func ParseXml(b []byte) (*XmlDocument, error) {
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = true
+	doc := &xmlNode{}
+	stack := []*xmlNode{doc}
+	offset := int64(0)
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := dec.InputOffset()
+		raw := string(b[offset:end])
+		offset = end
+		parent := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{raw: raw, name: qualifiedName(t.Name), attrs: t.Copy().Attr, element: true}
+			parent.children = append(parent.children, n)
+			if strings.HasSuffix(raw, "/>") {
+				n.selfClosing = true
+				// the decoder reports an end element for self closing tags without consuming input
+				if _, err := dec.RawToken(); err != nil {
+					return nil, err
+				}
+				offset = dec.InputOffset()
+				continue
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("unexpected end element '%s'", qualifiedName(t.Name))
+			}
+			parent.endRaw = raw
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			parent.children = append(parent.children, &xmlNode{raw: raw, text: true, name: string(t)})
+		default:
+			parent.children = append(parent.children, &xmlNode{raw: raw})
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("unexpected end of document")
+	}
+	return &XmlDocument{root: doc}, nil
+}
+
+// Bytes renders the document.
+func (d *XmlDocument) Bytes() []byte {
+	var sb strings.Builder
+	for _, c := range d.root.children {
+		c.write(&sb)
+	}
+	return []byte(sb.String())
+}
+
+func (n *xmlNode) write(sb *strings.Builder) {
+	switch {
+	case n.text && n.dirty:
+		_ = xml.EscapeText(sb, []byte(n.name))
+	case !n.element:
+		sb.WriteString(n.raw)
+	default:
+		if n.dirty {
+			sb.WriteString("<" + n.name)
+			for _, a := range n.attrs {
+				sb.WriteString(" " + qualifiedName(a.Name) + `="`)
+				_ = xml.EscapeText(sb, []byte(a.Value))
+				sb.WriteString(`"`)
+			}
+			if n.selfClosing && len(n.children) == 0 {
+				sb.WriteString("/>")
+				return
+			}
+			sb.WriteString(">")
+		} else if n.selfClosing && len(n.children) > 0 {
+			sb.WriteString(strings.TrimSuffix(strings.TrimSuffix(n.raw, "/>"), " ") + ">")
+		} else {
+			sb.WriteString(n.raw)
+			if n.selfClosing {
+				return
+			}
+		}
+		for _, c := range n.children {
+			c.write(sb)
+		}
+		if n.endRaw != "" && !n.selfClosing {
+			sb.WriteString(n.endRaw)
+		} else {
+			sb.WriteString("</" + n.name + ">")
+		}
+	}
+}
+
+// Set sets the attribute or the text content of the elements addressed by path.
+// Missing elements and attributes are created when create is set, attributes are always added.
+func (d *XmlDocument) Set(path, value string, create bool) error {
+	steps, err := parseXmlPath(path)
+	if err != nil {
+		return err
+	}
+	nodes, err := d.find(path, steps, create)
+	if err != nil {
+		return err
+	}
+	attr := steps[len(steps)-1].attr
+	for _, n := range nodes {
+		if attr != "" {
+			n.setAttr(attr, value)
+			continue
+		}
+		n.children = []*xmlNode{{text: true, name: value, dirty: true}}
+		if n.selfClosing {
+			n.dirty = true
+		}
+	}
+	return nil
+}
+
+// Get returns the attribute or text content of the first element addressed by path.
+func (d *XmlDocument) Get(path string) (string, bool, error) {
+	steps, err := parseXmlPath(path)
+	if err != nil {
+		return "", false, err
+	}
+	nodes, err := d.find(path, steps, false)
+	if err != nil || len(nodes) == 0 {
+		return "", false, nil
+	}
+	attr := steps[len(steps)-1].attr
+	if attr != "" {
+		for _, a := range nodes[0].attrs {
+			if qualifiedName(a.Name) == attr {
+				return a.Value, true, nil
+			}
+		}
+		return "", false, nil
+	}
+	var sb strings.Builder
+	for _, c := range nodes[0].children {
+		if c.text {
+			sb.WriteString(c.name)
+		}
+	}
+	return sb.String(), true, nil
+}
+
+// Delete removes the elements or attributes addressed by path and reports whether any existed.
+func (d *XmlDocument) Delete(path string) (bool, error) {
+	steps, err := parseXmlPath(path)
+	if err != nil {
+		return false, err
+	}
+	attr := steps[len(steps)-1].attr
+	if attr != "" {
+		nodes, err := d.find(path, steps, false)
+		if err != nil {
+			return false, nil
+		}
+		found := false
+		for _, n := range nodes {
+			found = n.removeAttr(attr) || found
+		}
+		return found, nil
+	}
+	parents := []*xmlNode{d.root}
+	if len(steps) > 1 {
+		parents, err = d.find(path, steps[:len(steps)-1], false)
+		if err != nil {
+			return false, nil
+		}
+	}
+	found := false
+	for _, p := range parents {
+		matches := p.match(steps[len(steps)-1])
+		for _, m := range matches {
+			p.removeChild(m)
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// find returns the elements addressed by steps, ignoring a final attribute selection.
+func (d *XmlDocument) find(path string, steps []xmlStep, create bool) ([]*xmlNode, error) {
+	nodes := []*xmlNode{d.root}
+	for i, step := range steps {
+		if step.name == "" {
+			break
+		}
+		var next []*xmlNode
+		for _, n := range nodes {
+			matches := n.match(step)
+			if len(matches) == 0 && create && step.position <= 1 && (i > 0 || len(n.elements()) == 0) {
+				child := &xmlNode{name: step.name, element: true, selfClosing: true, dirty: true}
+				if step.predAttr != "" {
+					child.attrs = []xml.Attr{{Name: xml.Name{Local: step.predAttr}, Value: step.predValue}}
+				}
+				n.appendChild(child)
+				matches = []*xmlNode{child}
+			}
+			next = append(next, matches...)
+		}
+		if len(next) == 0 {
+			return nil, fmt.Errorf("xml path '%s': element '%s' not found", path, step.name)
+		}
+		nodes = next
+	}
+	return nodes, nil
+}
+
+func (n *xmlNode) elements() []*xmlNode {
+	var el []*xmlNode
+	for _, c := range n.children {
+		if c.element {
+			el = append(el, c)
+		}
+	}
+	return el
+}
+
+func (n *xmlNode) match(step xmlStep) []*xmlNode {
+	var matches []*xmlNode
+	for _, c := range n.elements() {
+		if step.name != "*" && c.name != step.name {
+			continue
+		}
+		if step.predAttr != "" {
+			v, ok := c.attr(step.predAttr)
+			if !ok || v != step.predValue {
+				continue
+			}
+		}
+		matches = append(matches, c)
+	}
+	if step.position > 0 {
+		if step.position > len(matches) {
+			return nil
+		}
+		return matches[step.position-1 : step.position]
+	}
+	return matches
+}
+
+func (n *xmlNode) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if qualifiedName(a.Name) == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func (n *xmlNode) setAttr(name, value string) {
+	n.dirty = true
+	for i, a := range n.attrs {
+		if qualifiedName(a.Name) == name {
+			n.attrs[i].Value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func (n *xmlNode) removeAttr(name string) bool {
+	for i, a := range n.attrs {
+		if qualifiedName(a.Name) == name {
+			n.attrs = append(n.attrs[:i], n.attrs[i+1:]...)
+			n.dirty = true
+			return true
+		}
+	}
+	return false
+}
+
+// appendChild adds an element after the last element child, copying its indentation.
+func (n *xmlNode) appendChild(child *xmlNode) {
+	idx, indent := len(n.children), ""
+	for i := len(n.children) - 1; i >= 0; i-- {
+		if n.children[i].element {
+			idx = i + 1
+			if i > 0 && n.children[i-1].text {
+				indent = n.children[i-1].name
+			}
+			break
+		}
+	}
+	added := []*xmlNode{child}
+	if indent != "" && strings.TrimSpace(indent) == "" {
+		added = []*xmlNode{{text: true, name: indent, raw: indent}, child}
+	}
+	n.children = append(n.children[:idx], append(added, n.children[idx:]...)...)
+}
+
+func (n *xmlNode) removeChild(child *xmlNode) {
+	for i, c := range n.children {
+		if c != child {
+			continue
+		}
+		// drop the indentation in front of the element as well
+		start := i
+		if i > 0 && n.children[i-1].text && strings.TrimSpace(n.children[i-1].name) == "" {
+			start = i - 1
+		}
+		n.children = append(n.children[:start], n.children[i+1:]...)
+		return
+	}
+}
+
+// parseXmlPath parses an XPath like path, e.g. /Configuration/Loggers/Logger[@name='com.app']/@level
+// or /server/connectors/connector[2]. Paths are always absolute, a leading slash is optional.
+func parseXmlPath(path string) ([]xmlStep, error) {
+	trimmed := strings.TrimPrefix(path, "/")
+	if trimmed == "" {
+		return nil, fmt.Errorf("xml path '%s': empty path", path)
+	}
+	parts := splitXmlPath(trimmed)
+	steps := make([]xmlStep, 0, len(parts))
+	for i, part := range parts {
+		if strings.HasPrefix(part, "@") {
+			if i != len(parts)-1 || len(part) == 1 {
+				return nil, fmt.Errorf("xml path '%s': attribute must be the last step", path)
+			}
+			steps = append(steps, xmlStep{attr: part[1:]})
+			continue
+		}
+		step := xmlStep{name: part}
+		if open := strings.IndexByte(part, '['); open >= 0 {
+			if !strings.HasSuffix(part, "]") || open == 0 {
+				return nil, fmt.Errorf("xml path '%s': invalid step '%s'", path, part)
+			}
+			step.name = part[:open]
+			pred := part[open+1 : len(part)-1]
+			if strings.HasPrefix(pred, "@") {
+				eq := strings.IndexByte(pred, '=')
+				if eq < 0 {
+					return nil, fmt.Errorf("xml path '%s': invalid predicate '%s'", path, pred)
+				}
+				step.predAttr = pred[1:eq]
+				step.predValue = strings.Trim(pred[eq+1:], `'"`)
+			} else {
+				pos, err := strconv.Atoi(pred)
+				if err != nil || pos < 1 {
+					return nil, fmt.Errorf("xml path '%s': invalid position '%s'", path, pred)
+				}
+				step.position = pos
+			}
+		}
+		if step.name == "" {
+			return nil, fmt.Errorf("xml path '%s': empty step", path)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// splitXmlPath splits on slashes outside of predicates, so that attribute values may contain slashes.
+func splitXmlPath(path string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '/':
+			if depth == 0 {
+				parts = append(parts, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, path[start:])
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
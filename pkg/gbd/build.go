@@ -0,0 +1,244 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/docker/docker/api/types"
+	"github.com/testcontainers/testcontainers-go"
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// DockerBuild builds the image of a dependency.
+// Context is the build context relative to the context dir (default the context dir itself) and Dockerfile
+// is relative to the build context. Secrets and SSH need BuildKit sessions, builds using them run through the
+// docker CLI. Built images are cached by the hash of their build, KeepImage also tags them as Image:Version.
+// BuildArgs take the same values as the env of a dependency, build args without a value are taken from the
+// environment. Build args, Labels and Tag are templates, see templateData. The rendered Tag must be a valid
+// docker tag.
+type DockerBuild struct {
+	Dockerfile string             `yaml:"dockerfile"`
+	BuildArgs  map[string]*string `yaml:"buildArgs"`
+	// BuildArgVars are the build args which are secret or read from a SecretSource, see EnvVar. In yaml they are
+	// written in buildArgs as well, they override the entries of BuildArgs.
+	BuildArgVars map[string]EnvVar `yaml:"-"`
+	BuildLog     bool              `yaml:"buildLog"`
+	Context      string            `yaml:"context,omitempty"`
+	Target       string            `yaml:"target,omitempty"`
+	Platform     string            `yaml:"platform,omitempty"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+	NoCache      bool              `yaml:"noCache,omitempty"`
+	Secrets      []BuildSecret     `yaml:"secrets,omitempty"`
+	// SSH are the ssh agent sockets or keys forwarded to the build, e.g. default or id=~/.ssh/id_ed25519
+	SSH       []string `yaml:"ssh,omitempty"`
+	KeepImage bool     `yaml:"keepImage,omitempty"`
+	// Tag replaces the Version of the dependency as the tag of the built image, e.g. {{ .Git.ShortCommit }}.
+	// Setting it keeps the image like KeepImage.
+	Tag string `yaml:"tag,omitempty"`
+}
+
+func (b *DockerBuild) UnmarshalYAML(value *yaml.Node) error {
+	type plain DockerBuild
+	rest, args := cutMappingEntry(value, "buildArgs")
+	if err := rest.Decode((*plain)(b)); err != nil {
+		return err
+	}
+	if args == nil {
+		return nil
+	}
+	var vars map[string]*EnvVar
+	if err := args.Decode(&vars); err != nil {
+		return err
+	}
+	b.BuildArgs = make(map[string]*string, len(vars))
+	for k, v := range vars {
+		switch {
+		case v == nil:
+			b.BuildArgs[k] = nil
+		case v.Secret || v.isSet():
+			if b.BuildArgVars == nil {
+				b.BuildArgVars = make(map[string]EnvVar)
+			}
+			b.BuildArgVars[k] = *v
+		default:
+			b.BuildArgs[k] = &v.Value
+		}
+	}
+	return nil
+}
+
+func (b DockerBuild) MarshalYAML() (any, error) {
+	type plain DockerBuild
+	return encodeWithEntry(plain(b), "buildArgs", b.buildArgs(), len(b.BuildArgVars) > 0)
+}
+
+// buildArgs returns the entries of BuildArgs and BuildArgVars.
+func (b *DockerBuild) buildArgs() map[string]*EnvVar {
+	if b.BuildArgs == nil && b.BuildArgVars == nil {
+		return nil
+	}
+	args := make(map[string]*EnvVar, len(b.BuildArgs)+len(b.BuildArgVars))
+	for k, v := range b.BuildArgs {
+		args[k] = nil
+		if v != nil {
+			args[k] = &EnvVar{Value: *v}
+		}
+	}
+	for k, v := range b.BuildArgVars {
+		v := v
+		args[k] = &v
+	}
+	return args
+}
+
+// dockerTag is the grammar of a docker image tag.
+var dockerTag = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// BuildSecret is a secret mounted in the build with RUN --mount=type=secret,id=<ID>, read from the host file
+// Src (relative to the context dir) or from the host environment variable Env.
+type BuildSecret struct {
+	ID  string `yaml:"id"`
+	Src string `yaml:"src,omitempty"`
+	Env string `yaml:"env,omitempty"`
+}
+
+// render returns a copy of the build with its Labels and Tag rendered.
+func (b *DockerBuild) render(data templateData) (*DockerBuild, error) {
+	out := *b
+	tag, err := renderTemplate("tag", b.Tag, data)
+	if err != nil {
+		return nil, fmt.Errorf("build tag: %w", err)
+	}
+	if tag != "" && !dockerTag.MatchString(tag) {
+		return nil, fmt.Errorf("build tag '%s' is not a valid docker tag: up to 128 letters, digits, '_', '.' and '-', "+
+			"not starting with '.' or '-' (see .Git.BranchSlug)", tag)
+	}
+	out.Tag = tag
+	if b.Labels != nil {
+		out.Labels = make(map[string]string, len(b.Labels))
+		for k, v := range b.Labels {
+			if out.Labels[k], err = renderTemplate(k, v, data); err != nil {
+				return nil, fmt.Errorf("build label '%s': %w", k, err)
+			}
+		}
+	}
+	return &out, nil
+}
+
+// imageTag returns the tag of the built image of a dependency, its Tag or else its version.
+func (b *DockerBuild) imageTag(version string) string {
+	if b.Tag != "" {
+		return b.Tag
+	}
+	return version
+}
+
+// needsCLI reports whether the build uses BuildKit features which the docker API client cannot provide.
+func (b *DockerBuild) needsCLI() bool {
+	return len(b.Secrets) > 0 || len(b.SSH) > 0
+}
+
+// contextDir returns the build context of the build.
+func (b *DockerBuild) contextDir(contextDir string) string {
+	if b.Context == "" {
+		return contextDir
+	}
+	if filepath.IsAbs(b.Context) {
+		return b.Context
+	}
+	return filepath.Join(contextDir, b.Context)
+}
+
+// fromDockerfile returns the testcontainers build of a dependency.
+func (b *DockerBuild) fromDockerfile(contextDir, repo, tag string, args map[string]*string) testcontainers.FromDockerfile {
+	return testcontainers.FromDockerfile{
+		Context:       b.contextDir(contextDir),
+		Dockerfile:    b.Dockerfile,
+		Repo:          repo,
+		Tag:           tag,
+		BuildArgs:     args,
+		PrintBuildLog: b.BuildLog,
+		BuildOptionsModifier: func(opts *types.ImageBuildOptions) {
+			opts.Target = b.Target
+			opts.Platform = b.Platform
+			opts.NoCache = b.NoCache
+			if len(b.Labels) > 0 {
+				if opts.Labels == nil {
+					opts.Labels = make(map[string]string)
+				}
+				for k, v := range b.Labels {
+					opts.Labels[k] = v
+				}
+			}
+		},
+	}
+}
+
+// cliArgs returns the arguments of 'docker build' for the build. Build args without a value are taken from
+// the environment, as with the docker CLI.
+func (b *DockerBuild) cliArgs(contextDir, image string, args map[string]*string) []string {
+	ctxDir := b.contextDir(contextDir)
+	cli := []string{"build", "-t", image}
+	if b.Dockerfile != "" {
+		cli = append(cli, "-f", filepath.Join(ctxDir, b.Dockerfile))
+	}
+	if b.Target != "" {
+		cli = append(cli, "--target", b.Target)
+	}
+	if b.Platform != "" {
+		cli = append(cli, "--platform", b.Platform)
+	}
+	if b.NoCache {
+		cli = append(cli, "--no-cache")
+	}
+	for _, k := range sortedKeys(b.Labels) {
+		cli = append(cli, "--label", k+"="+b.Labels[k])
+	}
+	for _, k := range sortedKeys(args) {
+		if v := args[k]; v != nil {
+			cli = append(cli, "--build-arg", k+"="+*v)
+		} else {
+			cli = append(cli, "--build-arg", k)
+		}
+	}
+	for _, s := range b.Secrets {
+		spec := "id=" + s.ID
+		switch {
+		case s.Src != "":
+			src := s.Src
+			if !filepath.IsAbs(src) {
+				src = filepath.Join(contextDir, src)
+			}
+			spec += ",src=" + src
+		case s.Env != "":
+			spec += ",env=" + s.Env
+		}
+		cli = append(cli, "--secret", spec)
+	}
+	for _, ssh := range b.SSH {
+		cli = append(cli, "--ssh", ssh)
+	}
+	return append(cli, ctxDir)
+}
+
+// buildImage builds the image of a container request ahead of the container creation and returns its tag.
+func buildImage(ctx context.Context, ctr *testcontainers.ContainerRequest) (string, error) {
+	provider, err := testcontainers.NewDockerProvider()
+	if err != nil {
+		return "", err
+	}
+	defer provider.Close()
+	return provider.BuildImage(ctx, ctr)
+}
+
+// buildImageCLI builds an image with the docker CLI and BuildKit.
+func buildImageCLI(ctx context.Context, b *DockerBuild, contextDir, image string, args map[string]*string) error {
+	if err := utils.DockerCLI(ctx, b.BuildLog, []string{"DOCKER_BUILDKIT=1"}, b.cliArgs(contextDir, image, args)...); err != nil {
+		return fmt.Errorf("build '%s': %w", image, err)
+	}
+	return nil
+}
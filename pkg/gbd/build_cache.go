@@ -0,0 +1,195 @@
+package gbd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/testcontainers/testcontainers-go"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// Labels of the images built by gbd: the hash of their build, the image they were built for and the cache key of
+// the build, see DockerBuild.cacheKey.
+const (
+	cacheLabel      string = "gbd.cache"
+	cacheImageLabel string = "gbd.cache.image"
+	cacheKeyLabel   string = "gbd.cache.key"
+	cacheTagPrefix  string = "gbd-"
+)
+
+// hash identifies a build: the files of its context (respecting .dockerignore), the Dockerfile, the build args
+// and the options which change the resulting image. Build args without a value are taken from the environment.
+func (b *DockerBuild) hash(contextDir string, args map[string]*string) (string, error) {
+	ctxDir := b.contextDir(contextDir)
+	dockerfile := b.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	df, err := os.ReadFile(filepath.Join(ctxDir, dockerfile))
+	if err != nil {
+		return "", err
+	}
+
+	extra := []string{"dockerfile=" + string(df), "target=" + b.Target, "platform=" + b.Platform}
+	for _, k := range sortedKeys(args) {
+		if v := args[k]; v != nil {
+			extra = append(extra, "arg "+k+"="+*v)
+		} else {
+			extra = append(extra, "arg "+k+"="+os.Getenv(k))
+		}
+	}
+	for _, k := range sortedKeys(b.Labels) {
+		extra = append(extra, "label "+k+"="+b.Labels[k])
+	}
+	for _, s := range b.Secrets {
+		extra = append(extra, fmt.Sprintf("secret %s %s %s", s.ID, s.Src, s.Env))
+	}
+	extra = append(extra, "ssh "+strings.Join(b.SSH, ","))
+	return utils.HashBuildContext(ctxDir, extra...)
+}
+
+// cacheKey identifies the builds of a dependency with its build args and options. A new build only replaces the
+// cached images of the same key, so that dependencies building one image with different args keep their caches.
+func (b *DockerBuild) cacheKey(dep Dependency, args map[string]*string) string {
+	parts := []string{dep.Image, dep.group(), b.Context, b.Dockerfile, b.Target, b.Platform}
+	for _, k := range sortedKeys(args) {
+		if v := args[k]; v != nil {
+			parts = append(parts, k+"="+*v)
+		} else {
+			parts = append(parts, k+"="+os.Getenv(k))
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// cacheTag is the tag of the image of a build hash.
+func cacheTag(hash string) string {
+	return cacheTagPrefix + hash[:12]
+}
+
+// buildDependency returns the image of a dependency built by gbd. Images are tagged with the hash of their build
+// and reused while it does not change, unless the Env is rebuilt or the build sets noCache. With keepImage or a
+// tag the image is also tagged as image:tag, see DockerBuild.imageTag. b is the rendered build of the dependency.
+func (e *Env) buildDependency(ctx context.Context, dep Dependency, b *DockerBuild, args map[string]*string) (string, error) {
+	hash, err := b.hash(e.ContextDir, args)
+	if err != nil {
+		return "", fmt.Errorf("build '%s': %w", dep.Image, err)
+	}
+	tag := fmt.Sprintf("%s:%s", dep.Image, cacheTag(hash))
+	key := b.cacheKey(dep, args)
+
+	cached, err := utils.ImageExists(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+	if cached && !e.Rebuild && !b.NoCache {
+		fmt.Printf("Using cached image '%s'\n", tag)
+	} else {
+		labeled := *b
+		labeled.Labels = map[string]string{cacheLabel: hash, cacheImageLabel: dep.Image, cacheKeyLabel: key}
+		for k, v := range b.Labels {
+			labeled.Labels[k] = v
+		}
+		if b.needsCLI() {
+			if err := buildImageCLI(ctx, &labeled, e.ContextDir, tag, args); err != nil {
+				return "", err
+			}
+		} else {
+			req := &testcontainers.ContainerRequest{
+				FromDockerfile: labeled.fromDockerfile(e.ContextDir, dep.Image, cacheTag(hash), args),
+			}
+			if _, err := buildImage(ctx, req); err != nil {
+				return "", fmt.Errorf("build '%s': %w", dep.Image, err)
+			}
+		}
+		e.pruneStaleCache(ctx, dep.Image, key, tag)
+	}
+
+	if b.KeepImage || b.Tag != "" {
+		if err := utils.TagImage(ctx, tag, fmt.Sprintf("%s:%s", dep.Image, b.imageTag(dep.Version))); err != nil {
+			return "", err
+		}
+	}
+	return tag, nil
+}
+
+// pruneStaleCache removes the older cached images of the cache key of a build, only the newest one, tag, is kept.
+// Only cache tags are removed, images kept with keepImage or a tag keep their other tags. Failures are reported,
+// the build is not failed.
+func (e *Env) pruneStaleCache(ctx context.Context, image, key, tag string) {
+	images, err := utils.ListImages(ctx, cacheKeyLabel+"="+key)
+	if err == nil {
+		_, err = utils.RemoveImages(ctx, staleCacheTags(images, image, tag)...)
+	}
+	if err != nil {
+		fmt.Printf("Could not remove the older cached images of '%s': %s\n", image, err)
+	}
+}
+
+// staleCacheTags returns the cache tags of image other than tag.
+func staleCacheTags(images []types.ImageSummary, image, tag string) []string {
+	var stale []string
+	for _, img := range images {
+		for _, t := range img.RepoTags {
+			if t != tag && strings.HasPrefix(t, image+":"+cacheTagPrefix) {
+				stale = append(stale, t)
+			}
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// PruneBuildCache removes the images cached by gbd builds. With keepLatest the most recent image of every
+// cache key is kept. Only cache tags are removed, images kept with keepImage or a tag keep their other tags.
+// It returns the removed references.
+func PruneBuildCache(ctx context.Context, keepLatest bool) ([]string, error) {
+	images, err := utils.ListImages(ctx, cacheLabel)
+	if err != nil {
+		return nil, err
+	}
+	return utils.RemoveImages(ctx, prunedCacheRefs(images, keepLatest)...)
+}
+
+// prunedCacheRefs returns the cache tags of the images, untagged images by ID. With keepLatest the newest image of
+// every cache key is left out.
+func prunedCacheRefs(images []types.ImageSummary, keepLatest bool) []string {
+	sorted := slices.Clone(images)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created > sorted[j].Created
+	})
+
+	latest := make(map[string]bool)
+	var refs []string
+	for _, img := range sorted {
+		// images built before cache keys were labeled are grouped by image
+		key := img.Labels[cacheKeyLabel]
+		if key == "" {
+			key = img.Labels[cacheImageLabel]
+		}
+		if keepLatest && !latest[key] {
+			latest[key] = true
+			continue
+		}
+		if len(img.RepoTags) == 0 {
+			refs = append(refs, img.ID)
+			continue
+		}
+		for _, t := range img.RepoTags {
+			if strings.HasPrefix(t, img.Labels[cacheImageLabel]+":"+cacheTagPrefix) {
+				refs = append(refs, t)
+			}
+		}
+	}
+	return refs
+}
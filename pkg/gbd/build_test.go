@@ -0,0 +1,231 @@
+package gbd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDockerBuild(t *testing.T) {
+	version := "1.2.3"
+	b := &DockerBuild{
+		Dockerfile: "build/Dockerfile",
+		Context:    "services/api",
+		Target:     "runtime",
+		Platform:   "linux/amd64",
+		Labels:     map[string]string{"team": "core"},
+		NoCache:    true,
+		Secrets:    []BuildSecret{{ID: "npmrc", Src: ".npmrc"}, {ID: "token", Env: "GH_TOKEN"}},
+		SSH:        []string{"default"},
+	}
+	require.True(t, b.needsCLI())
+	require.False(t, (&DockerBuild{}).needsCLI())
+	require.Equal(t, "/repo/services/api", b.contextDir("/repo"))
+	require.Equal(t, "/repo", (&DockerBuild{}).contextDir("/repo"))
+
+	require.Equal(t, []string{
+		"build", "-t", "api:dev",
+		"-f", "/repo/services/api/build/Dockerfile",
+		"--target", "runtime",
+		"--platform", "linux/amd64",
+		"--no-cache",
+		"--label", "team=core",
+		"--build-arg", "HOME_DIR",
+		"--build-arg", "VERSION=1.2.3",
+		"--secret", "id=npmrc,src=/repo/.npmrc",
+		"--secret", "id=token,env=GH_TOKEN",
+		"--ssh", "default",
+		"/repo/services/api",
+	}, b.cliArgs("/repo", "api:dev", map[string]*string{"VERSION": &version, "HOME_DIR": nil}))
+
+	fd := b.fromDockerfile("/repo", "api", "dev", nil)
+	require.Equal(t, "/repo/services/api", fd.Context)
+	opts := types.ImageBuildOptions{Labels: map[string]string{"org.testcontainers": "true"}}
+	fd.BuildOptionsModifier(&opts)
+	require.Equal(t, "runtime", opts.Target)
+	require.Equal(t, "linux/amd64", opts.Platform)
+	require.True(t, opts.NoCache)
+	require.Equal(t, map[string]string{"org.testcontainers": "true", "team": "core"}, opts.Labels)
+}
+
+func TestExportScriptBuild(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	out := t.TempDir()
+	e := &Env{
+		ContextDir: "/repo/",
+		Dependencies: []Dependency{{
+			Image:   "api",
+			Version: "dev",
+			Build:   &DockerBuild{Context: "services/api", Target: "runtime", SSH: []string{"default"}},
+		}},
+	}
+	_, err := e.ExportScript(out)
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(out, exportScriptFile))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "export DOCKER_BUILDKIT=1\ndocker build \\\n  -t 'api:dev' \\\n  --target 'runtime' \\\n  --ssh 'default' \\\n  '/repo/services/api'\n")
+}
+
+func TestDockerBuildHash(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "api"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "api", "Dockerfile"), []byte("FROM alpine\n"), 0644))
+
+	b := &DockerBuild{Context: "api"}
+	v1, v2 := "1", "2"
+	hash, err := b.hash(dir, map[string]*string{"VERSION": &v1})
+	require.NoError(t, err)
+	again, err := b.hash(dir, map[string]*string{"VERSION": &v1})
+	require.NoError(t, err)
+	require.Equal(t, hash, again)
+	require.Equal(t, "gbd-"+hash[:12], cacheTag(hash))
+
+	other, err := b.hash(dir, map[string]*string{"VERSION": &v2})
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+
+	t.Setenv("GBD_TEST_ARG", "a")
+	fromEnv, err := b.hash(dir, map[string]*string{"GBD_TEST_ARG": nil})
+	require.NoError(t, err)
+	t.Setenv("GBD_TEST_ARG", "b")
+	changedEnv, err := b.hash(dir, map[string]*string{"GBD_TEST_ARG": nil})
+	require.NoError(t, err)
+	require.NotEqual(t, fromEnv, changedEnv)
+
+	_, err = (&DockerBuild{Dockerfile: "missing.Dockerfile"}).hash(dir, nil)
+	require.Error(t, err)
+}
+
+func TestStaleCacheTags(t *testing.T) {
+	images := []types.ImageSummary{
+		{RepoTags: []string{"api:gbd-000000000002"}},
+		{RepoTags: []string{"api:gbd-000000000001", "api:dev"}},
+		{RepoTags: []string{"api:gbd-000000000003"}},
+		{RepoTags: []string{"api-admin:gbd-000000000004"}},
+	}
+	// the newest build is kept, as are the tags of kept images
+	require.Equal(t, []string{"api:gbd-000000000001", "api:gbd-000000000003"}, staleCacheTags(images, "api", "api:gbd-000000000002"))
+	require.Empty(t, staleCacheTags(nil, "api", "api:gbd-000000000002"))
+}
+
+func TestCacheKey(t *testing.T) {
+	prod, debug := "prod", "debug"
+	b := &DockerBuild{Dockerfile: "Dockerfile"}
+	api := Dependency{Name: "api", Image: "api"}
+	key := b.cacheKey(api, map[string]*string{"MODE": &prod})
+	require.Len(t, key, 12)
+	require.Equal(t, key, b.cacheKey(api, map[string]*string{"MODE": &prod}))
+
+	// dependencies building one image with different args or names do not share their cache
+	require.NotEqual(t, key, b.cacheKey(api, map[string]*string{"MODE": &debug}))
+	require.NotEqual(t, key, b.cacheKey(Dependency{Name: "api-debug", Image: "api"}, map[string]*string{"MODE": &prod}))
+	require.NotEqual(t, key, (&DockerBuild{Dockerfile: "Dockerfile", Target: "test"}).cacheKey(api, map[string]*string{"MODE": &prod}))
+
+	// replicas share the build of their dependency
+	deps, err := expandReplicas([]Dependency{{Name: "api", Image: "api", Replicas: 2}})
+	require.NoError(t, err)
+	require.Equal(t, key, b.cacheKey(deps[1], map[string]*string{"MODE": &prod}))
+}
+
+func TestPrunedCacheRefs(t *testing.T) {
+	labels := func(key string) map[string]string {
+		return map[string]string{cacheLabel: "hash", cacheImageLabel: "api", cacheKeyLabel: key}
+	}
+	images := []types.ImageSummary{
+		{ID: "sha256:1", Created: 1, Labels: labels("prod"), RepoTags: []string{"api:gbd-000000000001", "api:1.0.0"}},
+		{ID: "sha256:2", Created: 2, Labels: labels("prod"), RepoTags: []string{"api:gbd-000000000002"}},
+		{ID: "sha256:3", Created: 3, Labels: labels("debug"), RepoTags: []string{"api:gbd-000000000003"}},
+		{ID: "sha256:4", Created: 0, Labels: labels("debug")},
+		{ID: "sha256:5", Created: 5, Labels: map[string]string{cacheLabel: "hash", cacheImageLabel: "api"}, RepoTags: []string{"api:gbd-000000000005"}},
+	}
+	// kept images only lose their cache tag, untagged images are removed by ID
+	require.Equal(t, []string{"api:gbd-000000000005", "api:gbd-000000000003", "api:gbd-000000000002", "api:gbd-000000000001", "sha256:4"},
+		prunedCacheRefs(images, false))
+	// the newest image of every cache key is kept, older images without a key are grouped by image
+	require.Equal(t, []string{"api:gbd-000000000001", "sha256:4"}, prunedCacheRefs(images, true))
+}
+
+func TestDockerBuildRender(t *testing.T) {
+	t.Setenv("GBD_TEST_REGISTRY", "registry.local")
+	version := "1.2.3"
+	data := templateData{
+		Values:  map[string]any{"version": version},
+		Secrets: map[string]string{"npm": "npm-token"},
+		Env:     hostEnv(),
+		Git:     GitInfo{Commit: "3f786850e387550fdab836ed7e6dc881de23001b", ShortCommit: "3f786850e387", Branch: "main"},
+	}
+	versionArg, registry := "{{ .Values.version }}", "{{ .Env.GBD_TEST_REGISTRY }}"
+	b := &DockerBuild{
+		BuildArgs: map[string]*string{
+			"VERSION":  &versionArg,
+			"REGISTRY": &registry,
+			"HOME_DIR": nil,
+		},
+		BuildArgVars: map[string]EnvVar{
+			"NPM_TOKEN": {SecretSource: SecretSource{SecretRef: "npm"}},
+		},
+		Labels: map[string]string{"org.opencontainers.image.revision": "{{ .Git.Commit }}"},
+		Tag:    "{{ .Git.Branch }}-{{ .Git.ShortCommit }}",
+	}
+
+	args, err := renderBuildArgs(b.buildArgs(), data)
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3", *args["VERSION"])
+	require.Equal(t, "registry.local", *args["REGISTRY"])
+	require.Equal(t, "npm-token", *args["NPM_TOKEN"])
+	require.Nil(t, args["HOME_DIR"])
+	require.Contains(t, args, "HOME_DIR")
+
+	rendered, err := b.render(data)
+	require.NoError(t, err)
+	require.Equal(t, "main-3f786850e387", rendered.imageTag(version))
+	require.Equal(t, "3f786850e387550fdab836ed7e6dc881de23001b", rendered.Labels["org.opencontainers.image.revision"])
+	// the build itself is left untouched
+	require.Equal(t, "{{ .Git.Commit }}", b.Labels["org.opencontainers.image.revision"])
+	require.Equal(t, version, (&DockerBuild{}).imageTag(version))
+
+	_, err = renderBuildArgs(map[string]*EnvVar{"X": {Value: "{{ .Env.GBD_TEST_MISSING }}"}}, data)
+	require.ErrorContains(t, err, "build arg 'X'")
+
+	// rendered tags must be valid docker tags
+	data.Git.Branch, data.Git.BranchSlug = "feature/x", branchSlug("feature/x")
+	_, err = b.render(data)
+	require.ErrorContains(t, err, "build tag 'feature/x-3f786850e387' is not a valid docker tag")
+	b.Tag = "{{ .Git.BranchSlug }}-{{ .Git.ShortCommit }}"
+	rendered, err = b.render(data)
+	require.NoError(t, err)
+	require.Equal(t, "feature-x-3f786850e387", rendered.Tag)
+	// outside a repository
+	_, err = b.render(templateData{})
+	require.ErrorContains(t, err, "build tag '-' is not a valid docker tag")
+	for branch, slug := range map[string]string{"main": "main", "feature/x": "feature-x", "-fix#12": "fix-12", "release/1.2_rc": "release-1.2_rc"} {
+		require.Equal(t, slug, branchSlug(branch))
+	}
+}
+
+func TestBuildArgsYAML(t *testing.T) {
+	var b DockerBuild
+	require.NoError(t, yaml.Unmarshal([]byte(`
+buildArgs:
+  VERSION: "{{ .Git.ShortCommit }}"
+  NPM_TOKEN:
+    secretRef: npm
+  HOME_DIR:
+`), &b))
+	require.Equal(t, "{{ .Git.ShortCommit }}", *b.BuildArgs["VERSION"])
+	require.Equal(t, "npm", b.BuildArgVars["NPM_TOKEN"].SecretRef)
+	require.NotContains(t, b.BuildArgs, "NPM_TOKEN")
+	require.Contains(t, b.BuildArgs, "HOME_DIR")
+	require.Nil(t, b.BuildArgs["HOME_DIR"])
+
+	out, err := yaml.Marshal(b)
+	require.NoError(t, err)
+	var back DockerBuild
+	require.NoError(t, yaml.Unmarshal(out, &back))
+	require.Equal(t, b.BuildArgs, back.BuildArgs)
+	require.Equal(t, b.BuildArgVars, back.BuildArgVars)
+}
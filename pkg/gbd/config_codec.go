@@ -0,0 +1,350 @@
+package gbd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// Operations of a Replacement, passed to ConfigDocument.Edit.
+const (
+	OpSet         = utils.OpSet
+	OpSetIfAbsent = utils.OpSetIfAbsent
+	OpDelete      = utils.OpDelete
+	OpAppend      = utils.OpAppend
+	OpMerge       = utils.OpMerge
+)
+
+// ConfigCodec parses config files of a format into documents that replacements are applied on.
+// Codecs are looked up by the 'format' of a ConfigReplacement, or else by the extension of its origin file.
+type ConfigCodec interface {
+	Parse(b []byte) (ConfigDocument, error)
+}
+
+// ConfigDocument is a parsed config file. Edit applies a single replacement in place, op being one of the
+// Op constants (a codec may reject the ones it cannot support) and value already coerced to its Type.
+// Bytes renders the edited file, keeping the formatting of the original as far as the format allows.
+type ConfigDocument interface {
+	Edit(key, op string, value any, create bool) error
+	Bytes() ([]byte, error)
+}
+
+var (
+	codecsMu   sync.RWMutex
+	codecs     = make(map[string]ConfigCodec)
+	extensions = make(map[string]string)
+)
+
+func init() {
+	RegisterConfigCodec("yaml", yamlCodec{}, ".yaml", ".yml")
+	RegisterConfigCodec("json", jsonCodec{}, ".json")
+	RegisterConfigCodec("properties", propertiesCodec{}, ".properties")
+	RegisterConfigCodec("env", propertiesCodec{dotenv: true}, ".env")
+	RegisterConfigCodec("ini", iniCodec{}, ".ini")
+	RegisterConfigCodec("xml", xmlCodec{}, ".xml")
+}
+
+// RegisterConfigCodec registers codec under the format name and for the given file extensions (with the leading dot).
+// Registering an existing format or extension replaces it, so built-in codecs can be overridden.
+func RegisterConfigCodec(format string, codec ConfigCodec, exts ...string) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[format] = codec
+	for _, ext := range exts {
+		extensions[strings.ToLower(ext)] = format
+	}
+}
+
+// lookupConfigCodec returns the codec of the format named explicitly or else the one matching the file extension.
+func lookupConfigCodec(path, format string) (ConfigCodec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if format == "" {
+		format = extensions[strings.ToLower(filepath.Ext(path))]
+	}
+	c, ok := codecs[format]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported config format '%s'", path, format)
+	}
+	return c, nil
+}
+
+// copyFileFromImage reads the origin files of fromImage replacements, replaced in tests.
+var copyFileFromImage = utils.CopyFileFromImage
+
+// loadConfig parses the origin file of a ConfigReplacement, either from the context dir or from inside image.
+func loadConfig(ctx context.Context, r ConfigReplacement, contextDir, image string) (ConfigDocument, error) {
+	if !r.FromImage {
+		return parseConfig(contextDir+r.ConfigOriginPath, r.Format)
+	}
+	b, err := copyFileFromImage(ctx, image, registryAuth(ctx, image), r.ConfigOriginPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigBytes(r.ConfigOriginPath, b, r.Format)
+}
+
+func parseConfig(path, format string) (ConfigDocument, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigBytes(path, b, format)
+}
+
+func parseConfigBytes(path string, b []byte, format string) (ConfigDocument, error) {
+	codec, err := lookupConfigCodec(path, format)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := codec.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func flushConfig(target string, cfg ConfigDocument) error {
+	bytes, err := cfg.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(target, bytes, 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func replaceConfigValue(rep Replacement, value any, cfg ConfigDocument) error {
+	op := rep.Op
+	if op == "" {
+		op = OpSet
+	}
+	if op != OpDelete {
+		var err error
+		value, err = utils.CoerceValue(value, rep.Type)
+		if err != nil {
+			return fmt.Errorf("key '%s': %w", rep.Key, err)
+		}
+	}
+	return cfg.Edit(rep.Key, op, value, rep.CreateMissing)
+}
+
+type yamlCodec struct{}
+
+func (yamlCodec) Parse(b []byte) (ConfigDocument, error) {
+	root, err := utils.ParseNode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeDocument{root: root, indent: utils.DetectIndent(b, 2)}, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Parse(b []byte) (ConfigDocument, error) {
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("invalid json")
+	}
+	root, err := utils.ParseNode(b)
+	if err != nil {
+		return nil, err
+	}
+	indent := 0
+	if strings.Contains(strings.TrimSpace(string(b)), "\n") {
+		indent = utils.DetectIndent(b, 2)
+	}
+	return &nodeDocument{root: root, indent: indent, json: true}, nil
+}
+
+// nodeDocument is a yaml or json document edited on its yaml node tree, keeping comments, key order and anchors.
+type nodeDocument struct {
+	root   *yaml.Node
+	indent int
+	json   bool
+}
+
+func (d *nodeDocument) Edit(key, op string, value any, create bool) error {
+	path, err := utils.ParseKeyPath(key)
+	if err != nil {
+		return err
+	}
+	var node *yaml.Node
+	if op != OpDelete {
+		node, err = utils.ValueNode(value)
+		if err != nil {
+			return err
+		}
+	}
+	return utils.EditNodePath(path, op, node, d.root, create)
+}
+
+func (d *nodeDocument) Bytes() ([]byte, error) {
+	if d.json {
+		return utils.MarshalJSONNode(d.root, strings.Repeat(" ", d.indent))
+	}
+	var buf strings.Builder
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(d.indent)
+	if err := enc.Encode(d.root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(buf.String()), nil
+}
+
+type propertiesCodec struct {
+	dotenv bool
+}
+
+func (f propertiesCodec) Parse(b []byte) (ConfigDocument, error) {
+	if f.dotenv {
+		return &propertiesDocument{props: utils.ParseDotenv(b)}, nil
+	}
+	return &propertiesDocument{props: utils.ParseProperties(b)}, nil
+}
+
+// propertiesDocument is a flat .properties or .env file, keys are taken literally (dots included).
+type propertiesDocument struct {
+	props *utils.Properties
+}
+
+func (d *propertiesDocument) Edit(key, op string, value any, create bool) error {
+	switch op {
+	case OpDelete:
+		d.props.Delete(key)
+		return nil
+	case OpSetIfAbsent:
+		if _, ok := d.props.Get(key); ok {
+			return nil
+		}
+	case OpSet:
+	default:
+		return fmt.Errorf("key '%s': operation '%s' is not supported by flat config formats", key, op)
+	}
+	s, err := scalarString(key, value)
+	if err != nil {
+		return err
+	}
+	d.props.Set(key, s)
+	return nil
+}
+
+func (d *propertiesDocument) Bytes() ([]byte, error) {
+	return d.props.Bytes(), nil
+}
+
+type iniCodec struct{}
+
+func (iniCodec) Parse(b []byte) (ConfigDocument, error) {
+	return &iniDocument{ini: utils.ParseIni(b)}, nil
+}
+
+// iniDocument is an INI file, keys are addressed as 'section.key' or as 'key' outside of any section.
+// Quote section names that contain dots, e.g. '"my.section".key'.
+type iniDocument struct {
+	ini *utils.Ini
+}
+
+func (d *iniDocument) Edit(key, op string, value any, create bool) error {
+	path, err := utils.ParseKeyPath(key)
+	if err != nil {
+		return err
+	}
+	var section, name string
+	switch {
+	case len(path) == 1 && !path[0].IsIndex && !path[0].Wildcard:
+		name = path[0].Key
+	case len(path) == 2 && !path[0].IsIndex && !path[0].Wildcard && !path[1].IsIndex && !path[1].Wildcard:
+		section, name = path[0].Key, path[1].Key
+	default:
+		return fmt.Errorf("key '%s': ini keys are either 'section.key' or 'key'", key)
+	}
+	switch op {
+	case OpDelete:
+		d.ini.Delete(section, name)
+		return nil
+	case OpSetIfAbsent:
+		if _, ok := d.ini.Get(section, name); ok {
+			return nil
+		}
+	case OpSet:
+	default:
+		return fmt.Errorf("key '%s': operation '%s' is not supported by flat config formats", key, op)
+	}
+	if !create && !d.ini.HasSection(section) {
+		return fmt.Errorf("key '%s': section '%s' not found", key, section)
+	}
+	s, err := scalarString(key, value)
+	if err != nil {
+		return err
+	}
+	d.ini.Set(section, name, s)
+	return nil
+}
+
+func (d *iniDocument) Bytes() ([]byte, error) {
+	return d.ini.Bytes(), nil
+}
+
+type xmlCodec struct{}
+
+func (xmlCodec) Parse(b []byte) (ConfigDocument, error) {
+	doc, err := utils.ParseXml(b)
+	if err != nil {
+		return nil, err
+	}
+	return &xmlDocument{doc: doc}, nil
+}
+
+// xmlDocument is an xml file, keys are XPath like, e.g. '/Configuration/Loggers/Root/@level'.
+type xmlDocument struct {
+	doc *utils.XmlDocument
+}
+
+func (d *xmlDocument) Edit(key, op string, value any, create bool) error {
+	switch op {
+	case OpDelete:
+		_, err := d.doc.Delete(key)
+		return err
+	case OpSetIfAbsent:
+		_, ok, err := d.doc.Get(key)
+		if err != nil || ok {
+			return err
+		}
+		create = true
+	case OpSet:
+	default:
+		return fmt.Errorf("key '%s': operation '%s' is not supported by xml configs", key, op)
+	}
+	s, err := scalarString(key, value)
+	if err != nil {
+		return err
+	}
+	return d.doc.Set(key, s, create)
+}
+
+func (d *xmlDocument) Bytes() ([]byte, error) {
+	return d.doc.Bytes(), nil
+}
+
+// scalarString renders a replacement value for the formats which only hold strings.
+func scalarString(key string, value any) (string, error) {
+	switch value.(type) {
+	case map[string]any, []any:
+		return "", fmt.Errorf("key '%s': only scalar values are supported by flat config formats", key)
+	case nil:
+		return "", nil
+	}
+	return fmt.Sprint(value), nil
+}
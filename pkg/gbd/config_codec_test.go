@@ -0,0 +1,243 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// codecCase describes a sample document of a codec, with a key that exists in it and one that does not.
+type codecCase struct {
+	format  string
+	file    string
+	src     string
+	key     string
+	missing string
+	want    string
+}
+
+var codecCases = []codecCase{
+	{
+		format:  "yaml",
+		file:    "config.yaml",
+		src:     "# server\nserver:\n  host: localhost # bind\n  port: 80\n",
+		key:     "server.host",
+		missing: "server.tls",
+		want:    "# server\nserver:\n  host: replaced # bind\n  port: 80\n",
+	},
+	{
+		format:  "json",
+		file:    "config.json",
+		src:     "{\n  \"server\": {\n    \"port\": 80,\n    \"host\": \"localhost\"\n  }\n}\n",
+		key:     "server.host",
+		missing: "server.tls",
+		want:    "{\n  \"server\": {\n    \"port\": 80,\n    \"host\": \"replaced\"\n  }\n}\n",
+	},
+	{
+		format:  "properties",
+		file:    "application.properties",
+		src:     "# server\nserver.host=localhost\nserver.port=80\n",
+		key:     "server.host",
+		missing: "server.tls",
+		want:    "# server\nserver.host=replaced\nserver.port=80\n",
+	},
+	{
+		format:  "env",
+		file:    ".env",
+		src:     "# server\nSERVER_HOST=localhost\nSERVER_PORT=80\n",
+		key:     "SERVER_HOST",
+		missing: "SERVER_TLS",
+		want:    "# server\nSERVER_HOST=replaced\nSERVER_PORT=80\n",
+	},
+	{
+		format:  "ini",
+		file:    "config.ini",
+		src:     "; server\n[server]\nhost = localhost\nport = 80\n",
+		key:     "server.host",
+		missing: "server.tls",
+		want:    "; server\n[server]\nhost = replaced\nport = 80\n",
+	},
+	{
+		format:  "xml",
+		file:    "config.xml",
+		src:     "<!-- server -->\n<server port=\"80\">\n  <host>localhost</host>\n</server>\n",
+		key:     "/server/host",
+		missing: "/server/@tls",
+		want:    "<!-- server -->\n<server port=\"80\">\n  <host>replaced</host>\n</server>\n",
+	},
+}
+
+func TestConfigCodecConformance(t *testing.T) {
+	for _, tc := range codecCases {
+		t.Run(tc.format, func(t *testing.T) {
+			codec, err := lookupConfigCodec(tc.file, "")
+			require.NoError(t, err)
+			explicit, err := lookupConfigCodec("config.unknown", tc.format)
+			require.NoError(t, err)
+			require.Equal(t, codec, explicit)
+
+			parse := func(src string) ConfigDocument {
+				doc, err := codec.Parse([]byte(src))
+				require.NoError(t, err)
+				return doc
+			}
+
+			// an untouched document is written back unchanged
+			b, err := parse(tc.src).Bytes()
+			require.NoError(t, err)
+			require.Equal(t, tc.src, string(b))
+
+			// set only changes the replaced value
+			doc := parse(tc.src)
+			require.NoError(t, doc.Edit(tc.key, OpSet, "replaced", false))
+			b, err = doc.Bytes()
+			require.NoError(t, err)
+			require.Equal(t, tc.want, string(b))
+
+			// setIfAbsent keeps existing values and adds missing ones
+			doc = parse(tc.src)
+			require.NoError(t, doc.Edit(tc.key, OpSetIfAbsent, "replaced", false))
+			require.NoError(t, doc.Edit(tc.missing, OpSetIfAbsent, "added", false))
+			b, err = doc.Bytes()
+			require.NoError(t, err)
+			require.NotContains(t, string(b), "replaced")
+			require.Contains(t, string(b), "added")
+
+			// delete removes the key and ignores missing ones, the result can be parsed again
+			doc = parse(tc.src)
+			require.NoError(t, doc.Edit(tc.key, OpDelete, nil, false))
+			require.NoError(t, doc.Edit(tc.missing, OpDelete, nil, false))
+			b, err = doc.Bytes()
+			require.NoError(t, err)
+			require.NotContains(t, string(b), "localhost")
+			parse(string(b))
+
+			require.Error(t, parse(tc.src).Edit(tc.key, "unknown", "x", false))
+		})
+	}
+}
+
+func TestRegisterConfigCodec(t *testing.T) {
+	_, err := lookupConfigCodec("config.hcl", "")
+	require.Error(t, err)
+
+	RegisterConfigCodec("hcl", propertiesCodec{}, ".hcl")
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, "hcl")
+		delete(extensions, ".hcl")
+		codecsMu.Unlock()
+	}()
+
+	dir := t.TempDir()
+	origin := filepath.Join(dir, "config.hcl")
+	require.NoError(t, os.WriteFile(origin, []byte("host=localhost\n"), 0644))
+	cfg, err := parseConfig(origin, "")
+	require.NoError(t, err)
+	require.NoError(t, replaceConfigValue(Replacement{Key: "port", Value: "8080", Type: "int"}, "8080", cfg))
+	b, err := cfg.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, "host=localhost\nport=8080\n", string(b))
+}
+
+func TestLoadConfigFromImage(t *testing.T) {
+	files := map[string]string{"nginx:1.25 /etc/app/config.yaml": "server:\n  host: localhost\n"}
+	orig := copyFileFromImage
+	copyFileFromImage = func(ctx context.Context, image, auth, path string) ([]byte, error) {
+		content, ok := files[image+" "+path]
+		if !ok {
+			return nil, fmt.Errorf("image '%s': %s: no such file", image, path)
+		}
+		return []byte(content), nil
+	}
+	t.Cleanup(func() { copyFileFromImage = orig })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("server:\n  host: context\n"), 0644))
+
+	tests := []struct {
+		name string
+		r    ConfigReplacement
+		want string
+		err  string
+	}{
+		{
+			name: "image path",
+			r:    ConfigReplacement{ConfigOriginPath: "/etc/app/config.yaml", FromImage: true},
+			want: "server:\n  host: localhost\n",
+		},
+		{
+			name: "missing file in the image",
+			r:    ConfigReplacement{ConfigOriginPath: "/etc/app/missing.yaml", FromImage: true},
+			err:  "image 'nginx:1.25': /etc/app/missing.yaml: no such file",
+		},
+		{
+			name: "unsupported format of the image file",
+			r:    ConfigReplacement{ConfigOriginPath: "/etc/app/config.yaml", FromImage: true, Format: "toml"},
+			err:  "/etc/app/config.yaml: unsupported config format 'toml'",
+		},
+		{
+			name: "context dir",
+			r:    ConfigReplacement{ConfigOriginPath: "/config.yaml"},
+			want: "server:\n  host: context\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadConfig(context.Background(), tc.r, dir, "nginx:1.25")
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			b, err := cfg.Bytes()
+			require.NoError(t, err)
+			require.Equal(t, tc.want, string(b))
+		})
+	}
+}
+
+func TestConfigTargetPath(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		r    ConfigReplacement
+		want string
+		host string
+	}{
+		{
+			name: "absolute",
+			r:    ConfigReplacement{ConfigOriginPath: "/config.yaml", TargetPath: "/etc/app/config.yaml"},
+			want: "/etc/app/config.yaml",
+			host: "/etc/app/config.yaml",
+		},
+		{
+			name: "relative",
+			r:    ConfigReplacement{ConfigOriginPath: "/config.yaml", TargetPath: "conf/config.yaml"},
+			want: "conf/config.yaml",
+			host: filepath.Join(dir, "conf/config.yaml"),
+		},
+		{
+			name: "image origin by default",
+			r:    ConfigReplacement{ConfigOriginPath: "/etc/app/config.yaml", FromImage: true},
+			want: "/etc/app/config.yaml",
+			host: "/etc/app/config.yaml",
+		},
+		{
+			name: "image origin with a target",
+			r:    ConfigReplacement{ConfigOriginPath: "/etc/app/config.yaml", TargetPath: "/etc/app/override.yaml", FromImage: true},
+			want: "/etc/app/override.yaml",
+			host: "/etc/app/override.yaml",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.r.targetPath())
+			require.Equal(t, tc.host, hostPath(dir, tc.r.targetPath()))
+		})
+	}
+}
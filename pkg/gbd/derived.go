@@ -0,0 +1,227 @@
+package gbd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// resolveDerivedValue looks up a derived value, results are cached for the lifetime of the stack so that
+// commands are executed and files are read once per Build.
+func (s *Stack) resolveDerivedValue(key string, value *ContainerDerivedValue) (any, error) {
+	cacheKey, _ := yaml.Marshal(value)
+	if cvalue, ok := s.cachedDerived(string(cacheKey)); ok {
+		return cvalue, nil
+	}
+	// certificates are issued before any container is started
+	if value.FromTLS != "" {
+		cert, ok := s.data.TLS[value.FromTLS]
+		if !ok {
+			return nil, fmt.Errorf("replacement '%s': no certificate issued for '%s'", key, value.FromTLS)
+		}
+		cvalue, err := cert.property(value.ContainerPropertyPath)
+		if err != nil {
+			return nil, fmt.Errorf("replacement '%s': %w", key, err)
+		}
+		return cvalue, nil
+	}
+	if value.FromHost != "" {
+		if value.FromHost != hostAddressProperty {
+			return nil, fmt.Errorf("replacement '%s': unknown host property '%s'", key, value.FromHost)
+		}
+		cvalue, err := s.hostAddress(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("replacement '%s': %w", key, err)
+		}
+		s.cacheDerived(string(cacheKey), cvalue)
+		return cvalue, nil
+	}
+	// a dependency with replicas resolves to its first replica
+	for _, c := range s.snapshot() {
+		if c.Name != value.component() && c.Group != value.component() {
+			continue
+		}
+		if c.process != nil && value.FromLogs == "" {
+			return nil, fmt.Errorf("replacement '%s': '%s' is a process, only fromLogs is supported", key, c.Name)
+		}
+		var cvalue any
+		var err error
+		switch {
+		case value.FromLogs != "":
+			cvalue, err = c.valueFromLogs(value.Regex, value.Group)
+		case value.FromExec != "":
+			cvalue, err = c.valueFromExec(value.Command, value.JSONPath)
+		case value.FromFile != "":
+			cvalue, err = c.valueFromFile(value.Path, value.JSONPath)
+		default:
+			cvalue, err = c.valueFromInspect(value.ContainerPropertyPath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replacement '%s': container '%s': %w", key, c.Name, err)
+		}
+		s.cacheDerived(string(cacheKey), cvalue)
+		return cvalue, nil
+	}
+	return nil, fmt.Errorf("replacement '%s': container '%s' not found", key, value.component())
+}
+
+// cachedDerived returns a derived value resolved before, restarts clear the cache concurrently.
+func (s *Stack) cachedDerived(key string) (any, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.derived[key]
+	return v, ok
+}
+
+func (s *Stack) cacheDerived(key string, v any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.derived == nil {
+		s.derived = make(map[string]any)
+	}
+	s.derived[key] = v
+}
+
+// networkAddress reports whether a value is an address on the stack network, of a container or of the host,
+// which processes on the host reach through localhost instead.
+func (dv *ContainerDerivedValue) networkAddress() bool {
+	p := dv.ContainerPropertyPath
+	return dv.FromHost != "" || dv.FromContainer != "" && (strings.Contains(p, "Aliases") || strings.HasSuffix(p, "IPAddress"))
+}
+
+// valueFromInspect resolves a JSONPath into the docker inspect JSON of the container.
+func (c StackComponent) valueFromInspect(path string) (any, error) {
+	if strings.Contains(path, networkReplaceId) {
+		// external containers may be on none of the networks of the stack
+		if len(c.Networks) == 0 {
+			return nil, fmt.Errorf("container '%s' is not on a stack network", c.Name)
+		}
+		path = strings.Replace(path, networkReplaceId, fmt.Sprintf("\"%s\"", c.Networks[0]), 1)
+	}
+
+	// by ID, containers of the same image in concurrent stacks are not confused
+	containerCfg, err := utils.InspectContainerID(context.Background(), c.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+
+	cvalue, err := utils.FindValueInJson(containerCfg, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cvalue, nil
+}
+
+// valueFromLogs returns a capture group of the first match of pattern in the container logs.
+// The component has passed its wait strategy by then, so values printed on startup are present.
+func (c StackComponent) valueFromLogs(pattern string, group *int) (any, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	g := 0
+	if re.NumSubexp() > 0 {
+		g = 1
+	}
+	if group != nil {
+		g = *group
+	}
+	if g < 0 || g > re.NumSubexp() {
+		return nil, fmt.Errorf("regex '%s' has no capture group %d", pattern, g)
+	}
+
+	var rc io.ReadCloser
+	if c.process != nil {
+		rc, err = c.process.Logs(context.Background())
+	} else if c.Kind == KindExternal {
+		var logs []byte
+		logs, err = utils.ContainerLogs(context.Background(), c.ContainerId)
+		rc = io.NopCloser(bytes.NewReader(logs))
+	} else {
+		rc, err = c.container.Logs(context.Background())
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	logs, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	m := re.FindSubmatch(logs)
+	if m == nil {
+		return nil, fmt.Errorf("no log line matches '%s'", pattern)
+	}
+	return string(m[g]), nil
+}
+
+// valueFromExec runs cmd in the container and returns its stdout.
+func (c StackComponent) valueFromExec(cmd []string, jsonPath string) (any, error) {
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("fromExec requires a command")
+	}
+	var code int
+	var r io.Reader
+	var err error
+	if c.Kind == KindExternal {
+		var out []byte
+		code, out, err = utils.ContainerExec(context.Background(), c.ContainerId, cmd)
+		r = bytes.NewReader(out)
+	} else {
+		code, r, err = c.container.Exec(context.Background(), cmd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, r); err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("'%s' exited with code %d: %s", strings.Join(cmd, " "), code, strings.TrimSpace(stderr.String()))
+	}
+	return outputValue(stdout.Bytes(), jsonPath)
+}
+
+// valueFromFile returns the content of a file inside the container.
+func (c StackComponent) valueFromFile(path, jsonPath string) (any, error) {
+	if path == "" {
+		return nil, fmt.Errorf("fromFile requires a path")
+	}
+	if c.Kind == KindExternal {
+		b, err := utils.ReadContainerFile(context.Background(), c.ContainerId, path)
+		if err != nil {
+			return nil, err
+		}
+		return outputValue(b, jsonPath)
+	}
+	rc, err := c.container.CopyFileFromContainer(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return outputValue(b, jsonPath)
+}
+
+func outputValue(b []byte, jsonPath string) (any, error) {
+	if jsonPath == "" {
+		return strings.TrimSpace(string(b)), nil
+	}
+	v, err := utils.FindValueInJson(b, jsonPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", jsonPath, err)
+	}
+	return v, nil
+}
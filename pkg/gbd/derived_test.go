@@ -0,0 +1,134 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDerivedValue(t *testing.T) {
+	var reps []Replacement
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- key: db.host
+  value:
+    fromContainer: test-postgres
+    propertyName: NetworkSettings.Networks[{NETWORK_ID}].Aliases[0]
+- key: vault.token
+  value:
+    fromLogs: vault
+    regex: 'Root Token: (\S+)'
+- key: features
+  op: merge
+  value:
+    fromCache: true
+`), &reps))
+
+	dv, ok := derivedValue(reps[0].Value)
+	require.True(t, ok)
+	require.Equal(t, "test-postgres", dv.component())
+	require.Equal(t, "NetworkSettings.Networks[{NETWORK_ID}].Aliases[0]", dv.ContainerPropertyPath)
+
+	dv, ok = derivedValue(reps[1].Value)
+	require.True(t, ok)
+	require.Equal(t, "vault", dv.component())
+	require.Equal(t, `Root Token: (\S+)`, dv.Regex)
+	require.Nil(t, dv.Group)
+
+	_, ok = derivedValue(reps[2].Value)
+	require.False(t, ok)
+}
+
+func TestOutputValue(t *testing.T) {
+	v, err := outputValue([]byte("s.token\n"), "")
+	require.NoError(t, err)
+	require.Equal(t, "s.token", v)
+
+	v, err = outputValue([]byte(`{"auth": {"client_token": "abc", "ttl": 60}}`), "$.auth.client_token")
+	require.NoError(t, err)
+	require.Equal(t, "abc", v)
+
+	_, err = outputValue([]byte("not json"), "$.auth")
+	require.Error(t, err)
+
+	var dv ContainerDerivedValue
+	require.NoError(t, yaml.Unmarshal([]byte("fromExec: vault\ncommand: [vault, print, token]\njsonPath: $.token\n"), &dv))
+	require.Equal(t, "vault", dv.component())
+	require.Equal(t, "output of 'vault print token' in container 'vault'", dv.String())
+}
+
+func TestValueFromInspectWithoutNetwork(t *testing.T) {
+	// an external container on none of the networks of the stack
+	cmp := externalComponent(Dependency{Name: "kafka", Kind: KindExternal}, types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: "c1", Name: "/kafka"},
+		NetworkSettings:   &types.NetworkSettings{},
+	}, "gbd")
+	require.Empty(t, cmp.Networks)
+	_, err := cmp.valueFromInspect(aliasPropertyPath)
+	require.EqualError(t, err, "container 'kafka' is not on a stack network")
+}
+
+// logsContainer is a container whose logs are fixed, it stops without error and the other methods are not
+// implemented.
+type logsContainer struct {
+	testcontainers.Container
+	logs string
+	err  error
+}
+
+func (c logsContainer) Stop(context.Context, *time.Duration) error { return nil }
+
+func (c logsContainer) Terminate(context.Context) error { return nil }
+
+func (c logsContainer) Logs(context.Context) (io.ReadCloser, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return io.NopCloser(strings.NewReader(c.logs)), nil
+}
+
+func TestValueFromLogs(t *testing.T) {
+	c := StackComponent{Name: "vault", container: logsContainer{logs: "==> Vault server started\nUnseal Key: abc=\nRoot Token: hvs.123\n"}}
+	group := func(g int) *int { return &g }
+	tests := []struct {
+		name    string
+		c       StackComponent
+		pattern string
+		group   *int
+		want    any
+		err     string
+	}{
+		{name: "invalid regex", c: c, pattern: `Root Token: (\S+`, err: "error parsing regexp: missing closing ): `Root Token: (\\S+`"},
+		{name: "first group by default", c: c, pattern: `Root Token: (\S+)`, want: "hvs.123"},
+		{name: "whole match without groups", c: c, pattern: `Vault server \w+`, want: "Vault server started"},
+		{name: "explicit group", c: c, pattern: `(Unseal|Root) (Key|Token): (\S+)`, group: group(3), want: "abc="},
+		{name: "explicit whole match", c: c, pattern: `Root Token: (\S+)`, group: group(0), want: "Root Token: hvs.123"},
+		{name: "group out of range", c: c, pattern: `Root Token: (\S+)`, group: group(2), err: "regex 'Root Token: (\\S+)' has no capture group 2"},
+		{name: "negative group", c: c, pattern: `Root Token: (\S+)`, group: group(-1), err: "regex 'Root Token: (\\S+)' has no capture group -1"},
+		{name: "no line matches", c: c, pattern: `Recovery Key: (\S+)`, err: "no log line matches 'Recovery Key: (\\S+)'"},
+		{
+			name:    "logs unavailable",
+			c:       StackComponent{Name: "vault", container: logsContainer{err: fmt.Errorf("container is not running")}},
+			pattern: `Root Token: (\S+)`,
+			err:     "container is not running",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := tc.c.valueFromLogs(tc.pattern, tc.group)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, v)
+		})
+	}
+}
@@ -2,25 +2,49 @@ package gbd
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/go-connections/nat"
 	"github.com/testcontainers/testcontainers-go"
-	"github.com/testcontainers/testcontainers-go/network"
 	"gopkg.in/yaml.v3"
-
-	"github.com/PanagiotisGts/gbd/internal/utils"
 )
 
 type Env struct {
-	ContextDir   string       `yaml:"context"`
-	Dependencies []Dependency `yaml:"dependencies"`
-	Network      string       `yaml:"-"`
+	ContextDir   string           `yaml:"context"`
+	Dependencies []Dependency     `yaml:"dependencies"`
+	Values       map[string]Value `yaml:"values,omitempty"`
+	// ValuesFile persists the generated Values (relative to the context dir), so that rebuilds reuse them
+	ValuesFile string    `yaml:"valuesFile,omitempty"`
+	TLS        *StackTLS `yaml:"tls,omitempty"`
+	// SecretsFile is an encrypted secrets file (relative to the context dir) referenced by SecretSource.SecretRef,
+	// decrypted with the key in GBD_SECRETS_KEY or SecretsKeyFile
+	SecretsFile    string `yaml:"secretsFile,omitempty"`
+	SecretsKeyFile string `yaml:"secretsKeyFile,omitempty"`
+	// ImageRewrites are applied to the images of the dependencies before the ones of the user config, see ImageRewrite
+	ImageRewrites []ImageRewrite `yaml:"imageRewrites,omitempty"`
+	// PullPolicy is the default pull policy of the dependencies, see PullAlways, PullIfNotPresent and PullNever
+	PullPolicy string `yaml:"pullPolicy,omitempty"`
+	// ImagesArchive is loaded before the stack is built (relative to the context dir), see SaveImages. It is loaded
+	// once, unless it changes, and only when some of its images are missing
+	ImagesArchive string `yaml:"imagesArchive,omitempty"`
+	// Rebuild builds the images of the dependencies even when their build is cached
+	Rebuild bool `yaml:"-"`
+	// NoMask disables the masking of secrets in the output of gbd, for local debugging only
+	NoMask bool `yaml:"noMask,omitempty"`
+	// HostAccess maps host.docker.internal to the host in every container, see Dependency.ExtraHosts
+	HostAccess bool `yaml:"hostAccess,omitempty"`
+	// Networks of the stack, a single bridge network when empty
+	Networks []NetworkConfig `yaml:"networks,omitempty"`
+	// Network is an existing docker network joined as the default network of the stack, see NetworkConfig.External
+	Network string `yaml:"network,omitempty"`
+	// StackID prefixes the container names of the stack and labels its containers and networks, random when empty
+	StackID string `yaml:"stackId,omitempty"`
 }
 
 func newEnv(contextDir string, containers []Dependency) *Env {
@@ -30,66 +54,222 @@ func newEnv(contextDir string, containers []Dependency) *Env {
 	}
 }
 
-func (e *Env) Build(ctx context.Context, dumpConfig bool) (*Stack, error) {
-	nw, err := network.New(ctx)
+func (e *Env) Build(ctx context.Context, dumpConfig bool) (_ *Stack, err error) {
+	configs, err := e.networkConfigs()
+	if err != nil {
+		return nil, err
+	}
+	id, err := e.stackID()
 	if err != nil {
 		return nil, err
 	}
 	stack := &Stack{
-		network: nw,
+		id:       id,
+		networks: make(map[string]*testcontainers.DockerNetwork, len(configs)),
+		noMask:   e.NoMask,
 	}
 	stack.workDir = e.ContextDir
-	stack.tempDir = e.ContextDir + "env_builder"
-	err = os.Mkdir(stack.tempDir, 0755)
-	if err != nil {
-		return nil, err
+	// containers are removed by the reaper, processes on the host are not
+	defer func() {
+		if err != nil {
+			stack.stopProcesses()
+		}
+	}()
+	for _, nc := range configs {
+		nw, err := nc.create(ctx, stack.labels(""))
+		if err != nil {
+			return nil, err
+		}
+		stack.networks[nc.Name] = nw
+		if nc.External {
+			stack.joined = append(stack.joined, nc.Name)
+		}
+		if stack.network == nil {
+			stack.network = nw
+		}
+	}
+
+	if e.ImagesArchive != "" {
+		if err := loadImagesArchive(ctx, e.contextPath(e.ImagesArchive)); err != nil {
+			return nil, fmt.Errorf("images archive: %w", err)
+		}
 	}
 
 	if dumpConfig {
-		b, _ := yaml.Marshal(e)
+		b, _ := yaml.Marshal(e.masked())
 		if err := os.WriteFile(filepath.Join(stack.workDir, "test_env.yaml"), b, 0644); err != nil {
 			fmt.Println(err)
 		}
 	}
 
-	defer os.RemoveAll(stack.tempDir)
-	for i := range e.Dependencies {
-		ctr := baseContainerRequest(e.Dependencies[i].Image, e.Dependencies[i].Version, e.Dependencies[i].Env)
-		if e.Dependencies[i].Name != "" {
-			ctr.Name = e.Dependencies[i].Name
+	values, err := e.generateValues()
+	if err != nil {
+		return nil, err
+	}
+	ca, certs, err := e.issueCertificates()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.writeCAFile(ca); err != nil {
+		return nil, err
+	}
+	secrets, err := e.loadSecrets()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := e.imageRewrites()
+	if err != nil {
+		return nil, err
+	}
+	git, err := gitInfo(e.ContextDir)
+	if err != nil {
+		return nil, err
+	}
+	stack.data = templateData{
+		Values:     values,
+		TLS:        certs,
+		Secrets:    secrets,
+		Env:        hostEnv(),
+		Git:        git,
+		contextDir: e.ContextDir,
+		deps:       e.Dependencies,
+		stack:      stack,
+		hostAccess: e.HostAccess,
+	}
+	if ca != nil {
+		stack.data.CA = string(ca.CertPEM)
+	}
+	stack.addSecrets(values)
+	for _, c := range certs {
+		stack.secrets = append(stack.secrets, c.Key)
+	}
+	for _, v := range secrets {
+		stack.addSecret(v)
+	}
+
+	deps, err := expandReplicas(e.Dependencies)
+	if err != nil {
+		return nil, err
+	}
+	for i := range deps {
+		data := stack.data
+		data.Index = deps[i].replicaIndex()
+		data.host = deps[i].isProcess()
+		vars := deps[i].envVars()
+		env, err := renderEnv(vars, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", deps[i].Name, err)
+		}
+		for k, v := range vars {
+			if v.Secret || v.isSet() || isSecretKey(k) {
+				stack.addSecret(env[k])
+			}
+		}
+		if deps[i].isProcess() {
+			cmp, err := stack.startProcess(ctx, deps[i], env, data)
+			if err != nil {
+				return nil, err
+			}
+			stack.addComponent(cmp)
+			continue
+		}
+		if deps[i].isExternal() {
+			cmp, err := stack.attachExternal(ctx, deps[i])
+			if err != nil {
+				return nil, err
+			}
+			stack.addComponent(cmp)
+			continue
+		}
+		image := deps[i].Image
+		if deps[i].Build == nil {
+			image = rewriteImage(rules, image)
+		}
+		ctr := baseContainerRequest(image, deps[i].Version, env)
+		if deps[i].Name != "" {
+			ctr.Name = stack.containerName(deps[i].Name)
+		}
+		ctr.Labels = stack.labels(deps[i].group())
+		if deps[i].replica != nil {
+			ctr.Labels[replicaLabel] = strconv.Itoa(deps[i].replica.index)
+		}
+		restart, err := deps[i].restartPolicy()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", deps[i].Name, err)
+		}
+		if !restart.IsNone() {
+			modifier := ctr.HostConfigModifier
+			ctr.HostConfigModifier = func(hostConfig *container.HostConfig) {
+				modifier(hostConfig)
+				hostConfig.RestartPolicy = restart
+			}
+		}
+		if hosts := e.extraHosts(deps[i]); len(hosts) > 0 {
+			modifier := ctr.HostConfigModifier
+			ctr.HostConfigModifier = func(hostConfig *container.HostConfig) {
+				modifier(hostConfig)
+				hostConfig.ExtraHosts = append(hostConfig.ExtraHosts, hosts...)
+			}
 		}
 
-		if e.Dependencies[i].Build != nil {
-			ctr.FromDockerfile = testcontainers.FromDockerfile{
-				Context:       e.ContextDir,
-				Dockerfile:    e.Dependencies[i].Build.Dockerfile,
-				Repo:          e.Dependencies[i].Image,
-				Tag:           e.Dependencies[i].Version,
-				BuildArgs:     e.Dependencies[i].Build.BuildArgs,
-				PrintBuildLog: e.Dependencies[i].Build.BuildLog,
-				KeepImage:     false,
+		version := deps[i].Version
+		if b := deps[i].Build; b != nil {
+			rendered, err := b.render(stack.data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", deps[i].Name, err)
+			}
+			vars := b.buildArgs()
+			args, err := renderBuildArgs(vars, stack.data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", deps[i].Name, err)
 			}
-			ctr.Image = ""
+			for k, v := range vars {
+				if v != nil && (v.Secret || v.isSet() || isSecretKey(k)) {
+					stack.addSecret(*args[k])
+				}
+			}
+			tag, err := e.buildDependency(ctx, deps[i], rendered, rewriteBuildArgs(rules, args))
+			if err != nil {
+				return nil, err
+			}
+			ctr.Image = tag
+			// the component carries the tag of the image it runs, so that it can be traced to its build
+			version = strings.TrimPrefix(tag, image+":")
+			if rendered.KeepImage || rendered.Tag != "" {
+				version = rendered.imageTag(deps[i].Version)
+			}
+		} else if err := ensureImage(ctx, ctr.Image, e.pullPolicy(deps[i])); err != nil {
+			return nil, err
 		}
 
-		ctr.WaitingFor = e.Dependencies[i].WaitFor.WaitForStrategy
-		ctr.Networks = []string{nw.Name}
-		ctr.NetworkAliases = map[string][]string{nw.Name: {e.Dependencies[i].Alias}}
+		ctr.WaitingFor = deps[i].WaitFor.WaitForStrategy
+		attachments, err := dependencyNetworks(deps[i], configs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", deps[i].Name, err)
+		}
+		ctr.NetworkAliases = make(map[string][]string, len(attachments))
+		for _, a := range attachments {
+			name := stack.networks[a.name].Name
+			ctr.Networks = append(ctr.Networks, name)
+			// the container name has the stack prefix, the logical name stays resolvable on the stack networks
+			if n := deps[i].Name; n != "" && !slices.Contains(a.aliases, n) {
+				a.aliases = append(a.aliases, n)
+			}
+			ctr.NetworkAliases[name] = a.aliases
+		}
 		ctr.Files = make([]testcontainers.ContainerFile, 0)
-		ctr.ExposedPorts = e.Dependencies[i].ExposePorts
+		ctr.ExposedPorts = deps[i].ExposePorts
 
-		if err := stack.replaceConfigs(e.Dependencies[i].ReplaceConfig); err != nil {
+		if err := stack.replaceConfigs(ctx, deps[i].ReplaceConfig, ctr.Image, data); err != nil {
 			return nil, err
 		}
-		for _, r := range e.Dependencies[i].ReplaceConfig {
-			ctr.Files = append(ctr.Files, testcontainers.ContainerFile{
-				HostFilePath:      r.hostFile,
-				ContainerFilePath: r.TargetPath,
-				FileMode:          0644,
-			})
+		// rendered files may hold secrets, they are copied into the container from memory
+		var files []memoryFile
+		for _, r := range deps[i].ReplaceConfig {
+			files = append(files, memoryFile{target: r.targetPath(), content: r.rendered, mode: 0644})
 		}
 
-		for _, file := range e.Dependencies[i].Files {
+		for _, file := range deps[i].Files {
 			if file.HostFilePath != "" {
 				ctr.Files = append(ctr.Files, testcontainers.ContainerFile{
 					HostFilePath:      file.HostFilePath,
@@ -97,24 +277,24 @@ func (e *Env) Build(ctx context.Context, dumpConfig bool) (*Stack, error) {
 					FileMode:          file.Mode,
 				})
 			} else {
-				fn := utils.ExtractFileName(file.TargetPath)
-				f, err := os.Create(stack.tempDir + fn)
-				if err != nil {
-					panic(err)
+				content := file.Content
+				if file.Template {
+					rendered, err := renderTemplate(file.TargetPath, string(content), data)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", file.TargetPath, err)
+					}
+					content = []byte(rendered)
 				}
-				_, err = f.Write(file.Content)
-				if err != nil {
-					panic(err)
-				}
-				ctr.Files = append(ctr.Files, testcontainers.ContainerFile{
-					HostFilePath:      f.Name(),
-					ContainerFilePath: file.TargetPath,
-					FileMode:          file.Mode,
-				})
+				files = append(files, memoryFile{target: file.TargetPath, content: content, mode: file.Mode})
 			}
 
 		}
 
+		if deps[i].TLS != nil {
+			files = append(files, certs[deps[i].tlsName()].files(deps[i].TLS)...)
+		}
+		ctr.LifecycleHooks = append(ctr.LifecycleHooks, copyFilesHook(files))
+
 		tc, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
 			ContainerRequest: *ctr,
 			Started:          true,
@@ -122,13 +302,41 @@ func (e *Env) Build(ctx context.Context, dumpConfig bool) (*Stack, error) {
 		if err != nil {
 			return nil, err
 		}
-		cmp := createComponent(ctx, err, tc, e.Dependencies[i])
+		cmp := createComponent(ctx, err, tc, deps[i])
+		// the first network is the one of {NETWORK_ID}
+		cmp.Networks = ctr.Networks
+		// the image after rewrites and the tag it runs
+		cmp.Image = image
+		cmp.Version = version
 		stack.addComponent(cmp)
 	}
 
 	return stack, nil
 }
 
+// memoryFile is a file rendered by gbd, copied into the container without being written to the host.
+type memoryFile struct {
+	target  string
+	content []byte
+	mode    int64
+}
+
+// copyFilesHook copies files into a container after it is created, before it is started.
+func copyFilesHook(files []memoryFile) testcontainers.ContainerLifecycleHooks {
+	return testcontainers.ContainerLifecycleHooks{
+		PostCreates: []testcontainers.ContainerHook{
+			func(ctx context.Context, c testcontainers.Container) error {
+				for _, f := range files {
+					if err := c.CopyToContainer(ctx, f.content, f.target, f.mode); err != nil {
+						return fmt.Errorf("%s: %w", f.target, err)
+					}
+				}
+				return nil
+			},
+		},
+	}
+}
+
 func baseContainerRequest(image, version string, env map[string]string) *testcontainers.ContainerRequest {
 	return &testcontainers.ContainerRequest{
 		Image: fmt.Sprintf("%s:%s", image, version),
@@ -139,29 +347,6 @@ func baseContainerRequest(image, version string, env map[string]string) *testcon
 	}
 }
 
-func parseConfig(path string) (map[string]any, error) {
-	var cfg map[string]any
-	b, err := os.ReadFile(path)
-	if err != nil {
-		panic(err)
-	}
-	switch filepath.Ext(path) {
-	case ".yaml", ".yml":
-		if err := yaml.Unmarshal(b, &cfg); err != nil {
-			return nil, err
-		}
-	case ".json":
-		if err := json.Unmarshal(b, &cfg); err != nil {
-			return nil, err
-		}
-	case ".toml":
-		/*if err := toml.Unmarshal(b, &cfg); err != nil {
-			return nil, err
-		}*/
-	}
-	return cfg, nil
-}
-
 func createComponent(ctx context.Context, err error, tc testcontainers.Container, dep Dependency) StackComponent {
 	name, err := tc.Name(ctx)
 	networks, err := tc.Networks(ctx)
@@ -185,12 +370,25 @@ func createComponent(ctx context.Context, err error, tc testcontainers.Container
 		}
 		mappedPorts[port] = mappedPort.Port()
 	}
+	name = strings.TrimPrefix(name, "/")
+	// components are looked up by their logical name, unnamed dependencies by their random container name
+	logical := dep.Name
+	if logical == "" {
+		logical = name
+	}
+	var group string
+	if dep.replica != nil {
+		group = dep.replica.name
+	}
 	return StackComponent{
 		container:      tc,
+		Group:          group,
 		Image:          dep.Image,
 		Version:        dep.Version,
 		ContainerId:    tc.GetContainerID(),
-		Name:           strings.TrimPrefix(name, "/"),
+		Name:           logical,
+		ContainerName:  name,
+		Index:          dep.replicaIndex(),
 		Networks:       networks,
 		NetworkAliases: nwa,
 		InternalIP:     ip,
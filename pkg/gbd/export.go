@@ -0,0 +1,626 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/testcontainers/testcontainers-go/wait"
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+const (
+	exportComposeFile string = "docker-compose.yml"
+	exportScriptFile  string = "gbd-stack.sh"
+	aliasPropertyPath string = "NetworkSettings.Networks[" + networkReplaceId + "].Aliases[0]"
+	// exportWaitTimeout is the number of seconds the script waits for a service to be ready
+	exportWaitTimeout int = 60
+)
+
+// exportScriptWait are the functions of the script which wait for a service, failing after a timeout.
+const exportScriptWait = `wait_until() {
+  local name=$1 timeout=$2
+  shift 2
+  for _ in $(seq "$timeout"); do
+    if "$@"; then
+      return 0
+    fi
+    sleep 1
+  done
+  echo "$name is not ready after ${timeout}s" >&2
+  exit 1
+}
+
+healthy() {
+  [ "$(docker inspect -f '{{if .State.Health}}{{.State.Health.Status}}{{end}}' "$1" 2>/dev/null)" = "healthy" ]
+}
+
+logged() {
+  docker logs "$1" 2>&1 | grep -q "$2" -- "$3"
+}
+
+`
+
+type composeFile struct {
+	Services   map[string]*composeService `yaml:"services"`
+	Networks   map[string]composeNetwork  `yaml:"networks"`
+	Secrets    map[string]composeSecret   `yaml:"secrets,omitempty"`
+	Unresolved []string                   `yaml:"x-gbd-unresolved,omitempty"`
+}
+
+type composeService struct {
+	Image         string                           `yaml:"image"`
+	Build         *composeBuild                    `yaml:"build,omitempty"`
+	PullPolicy    string                           `yaml:"pull_policy,omitempty"`
+	ContainerName string                           `yaml:"container_name,omitempty"`
+	Environment   map[string]string                `yaml:"environment,omitempty"`
+	Ports         []string                         `yaml:"ports,omitempty"`
+	Volumes       []string                         `yaml:"volumes,omitempty"`
+	ExtraHosts    []string                         `yaml:"extra_hosts,omitempty"`
+	Restart       string                           `yaml:"restart,omitempty"`
+	Networks      map[string]composeServiceNetwork `yaml:"networks"`
+	DependsOn     map[string]composeDependsOn      `yaml:"depends_on,omitempty"`
+}
+
+type composeBuild struct {
+	Context    string             `yaml:"context"`
+	Dockerfile string             `yaml:"dockerfile,omitempty"`
+	Args       map[string]*string `yaml:"args,omitempty"`
+	Target     string             `yaml:"target,omitempty"`
+	Platforms  []string           `yaml:"platforms,omitempty"`
+	Labels     map[string]string  `yaml:"labels,omitempty"`
+	NoCache    bool               `yaml:"no_cache,omitempty"`
+	Secrets    []string           `yaml:"secrets,omitempty"`
+	SSH        []string           `yaml:"ssh,omitempty"`
+}
+
+type composeSecret struct {
+	File        string `yaml:"file,omitempty"`
+	Environment string `yaml:"environment,omitempty"`
+}
+
+type composeNetwork struct {
+	Driver     string            `yaml:"driver,omitempty"`
+	External   bool              `yaml:"external,omitempty"`
+	Internal   bool              `yaml:"internal,omitempty"`
+	EnableIPv6 bool              `yaml:"enable_ipv6,omitempty"`
+	IPAM       *composeIPAM      `yaml:"ipam,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+}
+
+type composeIPAM struct {
+	Config []composeIPAMConfig `yaml:"config"`
+}
+
+type composeIPAMConfig struct {
+	Subnet string `yaml:"subnet"`
+}
+
+type composeServiceNetwork struct {
+	Aliases []string `yaml:"aliases,omitempty"`
+}
+
+type composeDependsOn struct {
+	Condition string `yaml:"condition"`
+}
+
+// exportPlan is the translated form of an Env shared by the compose and script exporters.
+type exportPlan struct {
+	networks   []NetworkConfig
+	services   []exportService
+	unresolved []string
+}
+
+type exportService struct {
+	name     string
+	networks []networkAttachment
+	dep      Dependency
+	env      map[string]string
+	// buildArgs are the rendered build args of a built dependency
+	buildArgs map[string]*string
+	volumes   []string
+	logWait   *wait.LogStrategy
+	healthy   bool
+}
+
+// ExportCompose writes a docker-compose.yml equivalent of the Env to outDir, together with the
+// rendered replaceConfig files and inline file contents which are bind mounted into the services.
+// It returns the fields that could not be translated, these are also listed under 'x-gbd-unresolved'.
+func (e *Env) ExportCompose(outDir string) ([]string, error) {
+	plan, err := e.plan(outDir)
+	if err != nil {
+		return nil, err
+	}
+	cf := composeFile{
+		Services: make(map[string]*composeService),
+		Networks: make(map[string]composeNetwork, len(plan.networks)),
+	}
+	for _, nc := range plan.networks {
+		if nc.External {
+			cf.Networks[nc.Name] = composeNetwork{External: true}
+			continue
+		}
+		cn := composeNetwork{Driver: nc.Driver, Internal: nc.Internal, EnableIPv6: nc.IPv6, Labels: nc.Labels}
+		if cn.Driver == "" {
+			cn.Driver = "bridge"
+		}
+		if nc.Subnet != "" {
+			cn.IPAM = &composeIPAM{Config: []composeIPAMConfig{{Subnet: nc.Subnet}}}
+		}
+		cf.Networks[nc.Name] = cn
+	}
+	for i, svc := range plan.services {
+		if svc.logWait != nil {
+			plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: log wait strategy '%s' has no compose healthcheck equivalent", svc.name, svc.logWait.Log))
+		}
+		cs := &composeService{
+			Image:         fmt.Sprintf("%s:%s", svc.dep.Image, svc.dep.Version),
+			ContainerName: svc.dep.Name,
+			Environment:   svc.env,
+			Ports:         svc.dep.ExposePorts,
+			Volumes:       svc.volumes,
+			ExtraHosts:    e.extraHosts(svc.dep),
+			Restart:       svc.dep.Restart,
+			Networks:      make(map[string]composeServiceNetwork, len(svc.networks)),
+		}
+		for _, a := range svc.networks {
+			cs.Networks[a.name] = composeServiceNetwork{Aliases: a.aliases}
+		}
+		if svc.dep.Build == nil {
+			cs.PullPolicy = dockerPullPolicy(e.pullPolicy(svc.dep))
+		}
+		if b := svc.dep.Build; b != nil {
+			cs.Build = &composeBuild{
+				Context:    b.contextDir(e.ContextDir),
+				Dockerfile: b.Dockerfile,
+				Args:       svc.buildArgs,
+				Target:     b.Target,
+				Labels:     b.Labels,
+				NoCache:    b.NoCache,
+				SSH:        b.SSH,
+			}
+			if b.Platform != "" {
+				cs.Build.Platforms = []string{b.Platform}
+			}
+			for _, secret := range b.Secrets {
+				if cf.Secrets == nil {
+					cf.Secrets = make(map[string]composeSecret)
+				}
+				cs.Build.Secrets = append(cs.Build.Secrets, secret.ID)
+				cf.Secrets[secret.ID] = composeSecret{File: e.contextPath(secret.Src), Environment: secret.Env}
+			}
+		}
+		// gbd starts the dependencies sequentially, each one waiting for the previous ones to be ready
+		for _, prev := range plan.services[:i] {
+			if cs.DependsOn == nil {
+				cs.DependsOn = make(map[string]composeDependsOn)
+			}
+			cond := "service_started"
+			if prev.healthy {
+				cond = "service_healthy"
+			}
+			cs.DependsOn[prev.name] = composeDependsOn{Condition: cond}
+		}
+		cf.Services[svc.name] = cs
+	}
+
+	cf.Unresolved = plan.unresolved
+	b, err := yaml.Marshal(cf)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(outDir, exportComposeFile), b, 0644); err != nil {
+		return nil, err
+	}
+	return plan.unresolved, nil
+}
+
+// ExportScript writes a bash script to outDir that starts the Env with the plain docker CLI ('up', default)
+// or removes it ('down'). Rendered configs are written next to it as in ExportCompose.
+func (e *Env) ExportScript(outDir string) ([]string, error) {
+	plan, err := e.plan(outDir)
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	sb.WriteString("#!/usr/bin/env bash\n# Generated by gbd\nset -euo pipefail\n\n")
+	for _, u := range plan.unresolved {
+		sb.WriteString(fmt.Sprintf("# UNRESOLVED: %s\n", scriptComment(u)))
+	}
+	sb.WriteString("\n" + exportScriptWait)
+	sb.WriteString("DIR=\"$(cd \"$(dirname \"$0\")\" && pwd)\"\n\ndown() {\n")
+	for i := len(plan.services) - 1; i >= 0; i-- {
+		sb.WriteString(fmt.Sprintf("  docker rm -f %s >/dev/null 2>&1 || true\n", shellQuote(plan.services[i].name)))
+	}
+	for _, nc := range plan.networks {
+		if nc.External {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("  docker network rm %s >/dev/null 2>&1 || true\n", shellQuote(nc.Name)))
+	}
+	sb.WriteString("}\n\n")
+	sb.WriteString("if [ \"${1:-up}\" = \"down\" ]; then\n  down\n  exit 0\nfi\n\n")
+	for _, nc := range plan.networks {
+		if nc.External {
+			continue
+		}
+		sb.WriteString(strings.Join(networkCreateArgs(nc), " ") + " >/dev/null\n")
+	}
+
+	for _, svc := range plan.services {
+		image := fmt.Sprintf("%s:%s", svc.dep.Image, svc.dep.Version)
+		name := shellQuote(svc.name)
+		sb.WriteString(fmt.Sprintf("\n# %s\n", scriptComment(svc.name)))
+		if b := svc.dep.Build; b != nil {
+			// one line per flag, the tokens of the docker CLI are quoted
+			cli := b.cliArgs(e.ContextDir, image, svc.buildArgs)
+			args := []string{"docker build"}
+			for _, token := range cli[1 : len(cli)-1] {
+				if strings.HasPrefix(token, "-") {
+					args = append(args, token)
+					continue
+				}
+				args[len(args)-1] += " " + shellQuote(token)
+			}
+			args = append(args, shellQuote(cli[len(cli)-1]))
+			if b.needsCLI() {
+				sb.WriteString("export DOCKER_BUILDKIT=1\n")
+			}
+			sb.WriteString(strings.Join(args, " \\\n  ") + "\n")
+		}
+		// containers join the first network when created, the others are connected before they start
+		run := "docker run -d"
+		if len(svc.networks) > 1 {
+			run = "docker create"
+		}
+		args := []string{run, "--name " + name, "--network " + shellQuote(svc.networks[0].name)}
+		if svc.dep.Build == nil {
+			args = append(args, "--pull "+dockerPullPolicy(e.pullPolicy(svc.dep)))
+		}
+		for _, alias := range svc.networks[0].aliases {
+			args = append(args, "--network-alias "+shellQuote(alias))
+		}
+		for _, k := range sortedKeys(svc.env) {
+			args = append(args, "-e "+shellQuote(k+"="+svc.env[k]))
+		}
+		for _, p := range svc.dep.ExposePorts {
+			args = append(args, "-p "+shellQuote(p))
+		}
+		for _, h := range e.extraHosts(svc.dep) {
+			args = append(args, "--add-host "+shellQuote(h))
+		}
+		if svc.dep.Restart != "" {
+			args = append(args, "--restart "+shellQuote(svc.dep.Restart))
+		}
+		for _, v := range svc.volumes {
+			if rel, ok := strings.CutPrefix(v, "./"); ok {
+				args = append(args, "-v \"$DIR\"/"+shellQuote(rel))
+				continue
+			}
+			args = append(args, "-v "+shellQuote(v))
+		}
+		args = append(args, shellQuote(image))
+		sb.WriteString(strings.Join(args, " \\\n  ") + " >/dev/null\n")
+		for _, a := range svc.networks[1:] {
+			connect := []string{"docker network connect"}
+			for _, alias := range a.aliases {
+				connect = append(connect, "--alias "+shellQuote(alias))
+			}
+			sb.WriteString(strings.Join(append(connect, shellQuote(a.name), name), " ") + "\n")
+		}
+		if len(svc.networks) > 1 {
+			sb.WriteString(fmt.Sprintf("docker start %s >/dev/null\n", name))
+		}
+
+		switch {
+		case svc.logWait != nil:
+			grep := "-F"
+			if svc.logWait.IsRegexp {
+				grep = "-E"
+			}
+			sb.WriteString(fmt.Sprintf("wait_until %s %d logged %s %s %s\n", name, exportWaitTimeout, name, grep, shellQuote(svc.logWait.Log)))
+		case svc.healthy:
+			sb.WriteString(fmt.Sprintf("wait_until %s %d healthy %s\n", name, exportWaitTimeout, name))
+		}
+	}
+
+	target := filepath.Join(outDir, exportScriptFile)
+	if err := os.WriteFile(target, []byte(sb.String()), 0755); err != nil {
+		return nil, err
+	}
+	return plan.unresolved, nil
+}
+
+func (e *Env) plan(outDir string) (*exportPlan, error) {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	values, err := e.generateValues()
+	if err != nil {
+		return nil, err
+	}
+	ca, certs, err := e.issueCertificates()
+	if err != nil {
+		return nil, err
+	}
+	git, err := gitInfo(e.ContextDir)
+	if err != nil {
+		return nil, err
+	}
+	data := templateData{Values: values, TLS: certs, Env: hostEnv(), Git: git, deps: e.Dependencies, hostAccess: e.HostAccess}
+	if ca != nil {
+		data.CA = string(ca.CertPEM)
+		if err := os.WriteFile(filepath.Join(outDir, "ca.crt"), ca.CertPEM, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	rules, err := e.imageRewrites()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &exportPlan{}
+	if plan.networks, err = e.networkConfigs(); err != nil {
+		return nil, err
+	}
+	deps, err := expandReplicas(e.Dependencies)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i, dep := range deps {
+		data.Index = dep.replicaIndex()
+		if dep.isProcess() {
+			plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: processes on the host are not exported", dep.Name))
+			continue
+		}
+		if dep.isExternal() {
+			plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: external containers are not exported", dep.Name))
+			continue
+		}
+		svc := exportService{name: exportServiceName(dep, i, names), dep: dep}
+		names[svc.name] = true
+		if _, err := dep.restartPolicy(); err != nil {
+			return nil, fmt.Errorf("%s: %w", svc.name, err)
+		}
+		if svc.networks, err = dependencyNetworks(dep, plan.networks); err != nil {
+			return nil, fmt.Errorf("%s: %w", svc.name, err)
+		}
+		if dep.Build != nil {
+			build, err := dep.Build.render(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", svc.name, err)
+			}
+			svc.dep.Build = build
+			svc.dep.Version = build.imageTag(dep.Version)
+			vars := build.buildArgs()
+			args := make(map[string]*EnvVar, len(vars))
+			for _, k := range sortedKeys(vars) {
+				v := vars[k]
+				if v != nil && v.isSet() {
+					plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: build arg '%s' is a secret and is not exported", svc.name, k))
+					continue
+				}
+				args[k] = v
+			}
+			rendered, err := renderBuildArgs(args, data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", svc.name, err)
+			}
+			svc.buildArgs = rewriteBuildArgs(rules, rendered)
+		} else {
+			svc.dep.Image = rewriteImage(rules, dep.Image)
+		}
+		svcDir := filepath.Join(outDir, "configs", svc.name)
+		vars := dep.envVars()
+		plain := make(map[string]EnvVar, len(vars))
+		for k, v := range vars {
+			if v.isSet() {
+				plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: env '%s' is a secret and is not exported", svc.name, k))
+				continue
+			}
+			plain[k] = v
+		}
+		if svc.env, err = renderEnv(plain, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", svc.name, err)
+		}
+
+		for _, r := range dep.ReplaceConfig {
+			if r.FromImage && dep.Build != nil {
+				plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: '%s' is extracted from an image built by gbd", svc.name, r.ConfigOriginPath))
+				continue
+			}
+			cfg, err := loadConfig(context.Background(), r, e.ContextDir, fmt.Sprintf("%s:%s", svc.dep.Image, svc.dep.Version))
+			if err != nil {
+				return nil, err
+			}
+			for _, rep := range r.Replacements {
+				if rep.Source != nil {
+					plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: '%s' in '%s' is a secret and is not exported",
+						svc.name, rep.Key, r.ConfigOriginPath))
+					continue
+				}
+				value, err := renderValue(rep.Key, rep.Value, data)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", r.ConfigOriginPath, err)
+				}
+				if dv, ok := derivedValue(rep.Value); ok {
+					translated, ok := e.translateDerivedValue(dv, data)
+					if !ok {
+						plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: '%s' in '%s' is derived from %s",
+							svc.name, rep.Key, r.ConfigOriginPath, dv))
+						continue
+					}
+					value = translated
+				}
+				if err := replaceConfigValue(rep, value, cfg); err != nil {
+					return nil, fmt.Errorf("%s: %w", r.ConfigOriginPath, err)
+				}
+			}
+			if err := os.MkdirAll(svcDir, 0755); err != nil {
+				return nil, err
+			}
+			fn := filepath.Join(svcDir, utils.ExtractFileName(r.ConfigOriginPath))
+			if err := flushConfig(fn, cfg); err != nil {
+				return nil, err
+			}
+			svc.volumes = append(svc.volumes, bindMount(outDir, fn, r.targetPath()))
+		}
+
+		for _, file := range dep.Files {
+			if file.HostFilePath != "" {
+				svc.volumes = append(svc.volumes, fmt.Sprintf("%s:%s:ro", file.HostFilePath, file.TargetPath))
+				continue
+			}
+			if err := os.MkdirAll(svcDir, 0755); err != nil {
+				return nil, err
+			}
+			mode := os.FileMode(file.Mode)
+			if mode == 0 {
+				mode = 0644
+			}
+			content := file.Content
+			if file.Template {
+				rendered, err := renderTemplate(file.TargetPath, string(content), data)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", file.TargetPath, err)
+				}
+				content = []byte(rendered)
+			}
+			fn := filepath.Join(svcDir, utils.ExtractFileName(file.TargetPath))
+			if err := os.WriteFile(fn, content, mode); err != nil {
+				return nil, err
+			}
+			svc.volumes = append(svc.volumes, bindMount(outDir, fn, file.TargetPath))
+		}
+
+		if dep.TLS != nil {
+			tlsDir := filepath.Join(svcDir, "tls")
+			if err := os.MkdirAll(tlsDir, 0755); err != nil {
+				return nil, err
+			}
+			for _, f := range certs[dep.tlsName()].files(dep.TLS) {
+				fn := filepath.Join(tlsDir, utils.ExtractFileName(f.target))
+				if err := os.WriteFile(fn, f.content, os.FileMode(f.mode)); err != nil {
+					return nil, err
+				}
+				svc.volumes = append(svc.volumes, bindMount(outDir, fn, f.target))
+			}
+		}
+
+		// the image may lack the tools to probe a port from inside the container, such strategies are not
+		// translated to a healthcheck and the dependents only wait for the container to start
+		switch str := dep.WaitFor.WaitForStrategy.(type) {
+		case *wait.HTTPStrategy, *wait.HostPortStrategy:
+			plan.unresolved = append(plan.unresolved, fmt.Sprintf("%s: %s wait strategy has no healthcheck equivalent, dependents only wait for it to start",
+				svc.name, dep.WaitFor.Strategy))
+		case *wait.HealthStrategy:
+			svc.healthy = true
+		case *wait.LogStrategy:
+			svc.logWait = str
+		}
+		plan.services = append(plan.services, svc)
+	}
+	return plan, nil
+}
+
+// translateDerivedValue resolves the derived values which do not depend on a running container.
+// Only the network alias of a dependency, the issued certificates and with hostAccess the host are known ahead of time.
+func (e *Env) translateDerivedValue(dv *ContainerDerivedValue, data templateData) (string, bool) {
+	if dv.FromHost != "" {
+		return hostGatewayName, e.HostAccess && dv.FromHost == hostAddressProperty
+	}
+	if dv.FromTLS != "" {
+		cert, ok := data.TLS[dv.FromTLS]
+		if !ok {
+			return "", false
+		}
+		v, err := cert.property(dv.ContainerPropertyPath)
+		return v, err == nil
+	}
+	if dv.FromContainer == "" || dv.ContainerPropertyPath != aliasPropertyPath {
+		return "", false
+	}
+	for _, dep := range e.Dependencies {
+		if dep.Name == dv.FromContainer && dep.Alias != "" {
+			return dep.Alias, true
+		}
+	}
+	return "", false
+}
+
+func exportServiceName(dep Dependency, i int, taken map[string]bool) string {
+	name := dep.Name
+	if name == "" {
+		name = dep.Alias
+	}
+	if name == "" {
+		name = utils.ExtractFileName(dep.Image)
+	}
+	if taken[name] {
+		name = fmt.Sprintf("%s-%d", name, i)
+	}
+	return name
+}
+
+// networkCreateArgs returns the 'docker network create' command of a network.
+func networkCreateArgs(nc NetworkConfig) []string {
+	args := []string{"docker network create"}
+	if nc.Driver != "" {
+		args = append(args, "--driver "+shellQuote(nc.Driver))
+	}
+	if nc.Internal {
+		args = append(args, "--internal")
+	}
+	if nc.IPv6 {
+		args = append(args, "--ipv6")
+	}
+	if nc.Subnet != "" {
+		args = append(args, "--subnet "+shellQuote(nc.Subnet))
+	}
+	for _, k := range sortedKeys(nc.Labels) {
+		args = append(args, "--label "+shellQuote(k+"="+nc.Labels[k]))
+	}
+	return append(args, shellQuote(nc.Name))
+}
+
+// bindMount returns a volume definition relative to the export directory, so that the output can be moved around.
+func bindMount(outDir, hostPath, target string) string {
+	rel, err := filepath.Rel(outDir, hostPath)
+	if err != nil {
+		return fmt.Sprintf("%s:%s:ro", hostPath, target)
+	}
+	return fmt.Sprintf("./%s:%s:ro", filepath.ToSlash(rel), target)
+}
+
+// dockerPullPolicy translates a pull policy to the docker CLI and compose one.
+func dockerPullPolicy(policy string) string {
+	if policy == PullIfNotPresent {
+		return "missing"
+	}
+	return policy
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// scriptComment keeps text on a single comment line of the script.
+func scriptComment(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
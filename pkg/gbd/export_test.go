@@ -0,0 +1,112 @@
+package gbd
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the exports")
+
+func TestExportGolden(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+dependencies:
+  - image: postgres
+    version: "16"
+    name: db
+    env:
+      POSTGRES_PASSWORD: root
+    waitFor:
+      strategy: healthcheck
+  - image: redis
+    version: "7"
+    name: cache
+    waitFor:
+      strategy: port
+      waitForStrategy:
+        port: 6379/tcp
+  - image: api
+    version: latest
+    name: api
+    exposePorts:
+      - "8080:8080"
+    waitFor:
+      strategy: log
+      waitForStrategy:
+        log: listening on
+  - image: web
+    version: latest
+    name: web
+    waitFor:
+      strategy: http
+      waitForStrategy:
+        port: 80/tcp
+        path: /health
+`), &e))
+	e.ContextDir = t.TempDir()
+
+	out := t.TempDir()
+	unresolved, err := e.ExportCompose(out)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"cache: port wait strategy has no healthcheck equivalent, dependents only wait for it to start",
+		"web: http wait strategy has no healthcheck equivalent, dependents only wait for it to start",
+		"api: log wait strategy 'listening on' has no compose healthcheck equivalent",
+	}, unresolved)
+	requireGolden(t, filepath.Join(out, exportComposeFile), "docker-compose.yml")
+
+	_, err = e.ExportScript(out)
+	require.NoError(t, err)
+	requireGolden(t, filepath.Join(out, exportScriptFile), exportScriptFile)
+}
+
+func TestExportScriptQuotesNames(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+networks:
+  - name: frontend
+  - name: backend
+dependencies:
+  - image: postgres
+    version: "16"
+    name: "db'; touch pwned; echo '"
+    networks: [backend]
+    waitFor:
+      strategy: healthcheck
+  - image: api
+    version: latest
+    name: "api $(touch pwned)"
+    networks: [frontend, backend]
+    waitFor:
+      strategy: log
+      waitForStrategy:
+        log: listening on
+`), &e))
+	e.ContextDir = t.TempDir()
+
+	out := t.TempDir()
+	_, err := e.ExportScript(out)
+	require.NoError(t, err)
+	requireGolden(t, filepath.Join(out, exportScriptFile), "gbd-stack-quoted.sh")
+}
+
+// requireGolden compares a generated file with testdata/export/<golden>, which -update rewrites.
+func requireGolden(t *testing.T, path, golden string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	golden = filepath.Join("testdata", "export", golden)
+	if *update {
+		require.NoError(t, os.WriteFile(golden, got, 0644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got))
+}
@@ -0,0 +1,99 @@
+package gbd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// ExternalContainer selects the running container of an external dependency, by Container name (the name of the
+// dependency when both are empty) or by Labels. Exactly one running container must match.
+type ExternalContainer struct {
+	Container string            `yaml:"container,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+// attachExternal looks up the running container of an external dependency, e.g. a long-lived stack started
+// outside of gbd. Its component is used for templates and derived values, Teardown never stops it.
+func (s *Stack) attachExternal(ctx context.Context, dep Dependency) (StackComponent, error) {
+	if dep.Name == "" {
+		return StackComponent{}, fmt.Errorf("an external dependency requires a name")
+	}
+	if dep.Build != nil || dep.TLS != nil || dep.WaitFor.WaitForStrategy != nil || len(dep.Command) > 0 ||
+		len(dep.envVars()) > 0 || len(dep.Files) > 0 || len(dep.ReplaceConfig) > 0 || len(dep.Networks) > 0 || dep.Restart != "" {
+		return StackComponent{}, fmt.Errorf("%s: an external dependency is only selected, it is not configured by gbd", dep.Name)
+	}
+	var sel ExternalContainer
+	if dep.External != nil {
+		sel = *dep.External
+	}
+	if sel.Container == "" && len(sel.Labels) == 0 {
+		sel.Container = dep.Name
+	}
+	found, err := utils.FindRunningContainer(ctx, sel.Container, sel.Labels)
+	if err != nil {
+		return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+	}
+	raw, err := utils.InspectContainerID(ctx, found.ID)
+	if err != nil {
+		return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+	}
+	var info types.ContainerJSON
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+	}
+	var network string
+	if s.network != nil {
+		network = s.network.Name
+	}
+	cmp := externalComponent(dep, info, network)
+	if network != "" && (len(cmp.Networks) == 0 || cmp.Networks[0] != network) {
+		fmt.Printf("External '%s' is not on the network '%s' of the stack\n", dep.Name, network)
+	}
+	return cmp, nil
+}
+
+// externalComponent is the component of an external container. The default network of the stack is first
+// when the container is on it, the one of {NETWORK_ID}, and its ports are mapped by port/protocol.
+func externalComponent(dep Dependency, info types.ContainerJSON, network string) StackComponent {
+	cmp := StackComponent{
+		Kind:           KindExternal,
+		ContainerId:    info.ID,
+		Name:           dep.Name,
+		ContainerName:  strings.TrimPrefix(info.Name, "/"),
+		NetworkAliases: make(map[string][]string),
+		Ports:          make(map[string][]PortRef),
+		MappedPorts:    make(map[string]string),
+	}
+	if info.Config != nil {
+		cmp.Image = info.Config.Image
+	}
+	if info.NetworkSettings == nil {
+		return cmp
+	}
+	for _, name := range sortedKeys(info.NetworkSettings.Networks) {
+		cmp.Networks = append(cmp.Networks, name)
+		cmp.NetworkAliases[name] = info.NetworkSettings.Networks[name].Aliases
+	}
+	if i := slices.Index(cmp.Networks, network); i > 0 {
+		cmp.Networks = append(append([]string{network}, cmp.Networks[:i]...), cmp.Networks[i+1:]...)
+	}
+	if len(cmp.Networks) > 0 {
+		cmp.InternalIP = info.NetworkSettings.Networks[cmp.Networks[0]].IPAddress
+	}
+	for p, bindings := range info.NetworkSettings.Ports {
+		for _, b := range bindings {
+			cmp.Ports[p.Port()] = append(cmp.Ports[p.Port()], PortRef{HostIp: b.HostIP, Port: b.HostPort})
+		}
+		if len(bindings) > 0 {
+			cmp.MappedPorts[string(p)] = bindings[0].HostPort
+		}
+	}
+	return cmp
+}
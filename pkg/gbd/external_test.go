@@ -0,0 +1,101 @@
+package gbd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	dnetwork "github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExternal(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+network: platform
+networks:
+  - name: internal
+dependencies:
+  - kind: external
+    name: kafka
+    external:
+      labels: {com.docker.compose.service: kafka}
+  - image: api
+    version: latest
+    name: api
+    networks: [platform, internal]
+`), &e))
+	require.True(t, e.Dependencies[0].isExternal())
+	configs, err := e.networkConfigs()
+	require.NoError(t, err)
+	require.Equal(t, []NetworkConfig{{Name: "platform", External: true}, {Name: "internal"}}, configs)
+	_, err = (&Env{Network: "platform", Networks: []NetworkConfig{{Name: "platform"}}}).networkConfigs()
+	require.ErrorContains(t, err, "duplicate network")
+	_, err = (&Env{Networks: []NetworkConfig{{Name: "platform", External: true, Internal: true}}}).networkConfigs()
+	require.ErrorContains(t, err, "not configured by gbd")
+
+	info := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: "abc123", Name: "/platform-kafka-1"},
+		Config:            &container.Config{Image: "bitnami/kafka:3.6"},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: nat.PortMap{
+				"9092/tcp": {{HostIP: "0.0.0.0", HostPort: "19092"}},
+				"9093/tcp": nil,
+			}},
+			Networks: map[string]*dnetwork.EndpointSettings{
+				"default":  {IPAddress: "172.20.0.2"},
+				"platform": {IPAddress: "172.30.0.5", Aliases: []string{"kafka"}},
+			},
+		},
+	}
+	cmp := externalComponent(e.Dependencies[0], info, "platform")
+	require.Equal(t, KindExternal, cmp.Kind)
+	require.Equal(t, "kafka", cmp.Name)
+	require.Equal(t, "platform-kafka-1", cmp.ContainerName)
+	require.Equal(t, []string{"platform", "default"}, cmp.Networks)
+	require.Equal(t, "172.30.0.5", cmp.InternalIP)
+	require.Equal(t, map[string]string{"9092/tcp": "19092"}, cmp.MappedPorts)
+
+	s := &Stack{}
+	s.addComponent(cmp)
+	data := templateData{deps: e.Dependencies, stack: s}
+	out, err := renderTemplate("addr", `{{ .Address "kafka" 9092 }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, "platform-kafka-1:9092", out)
+	data.host = true
+	out, err = renderTemplate("addr", `{{ .Address "kafka" 9092 }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, "localhost:19092", out)
+
+	// the selection is the only configuration of an external dependency
+	_, err = s.attachExternal(context.Background(), Dependency{Kind: KindExternal})
+	require.ErrorContains(t, err, "requires a name")
+	_, err = s.attachExternal(context.Background(), Dependency{Kind: KindExternal, Name: "kafka", Env: map[string]string{"A": "b"}})
+	require.ErrorContains(t, err, "not configured by gbd")
+
+	e.ContextDir = t.TempDir()
+	dir := t.TempDir()
+	unresolved, err := e.ExportCompose(dir)
+	require.NoError(t, err)
+	require.Contains(t, unresolved, "kafka: external containers are not exported")
+	b, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	require.NoError(t, err)
+	var cf composeFile
+	require.NoError(t, yaml.Unmarshal(b, &cf))
+	require.Equal(t, composeNetwork{External: true}, cf.Networks["platform"])
+	require.NotContains(t, cf.Services, "kafka")
+
+	_, err = e.ExportScript(dir)
+	require.NoError(t, err)
+	b, err = os.ReadFile(filepath.Join(dir, exportScriptFile))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "'platform' >/dev/null")
+	require.NotContains(t, string(b), "docker network rm 'platform'")
+	require.Contains(t, string(b), "docker network create 'internal' >/dev/null\n")
+}
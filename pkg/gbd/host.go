@@ -0,0 +1,35 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// The host name of the host in the containers of an Env with HostAccess, mapped to the docker host gateway.
+const (
+	hostGatewayName string = "host.docker.internal"
+	hostGateway     string = "host-gateway"
+)
+
+// hostAddressProperty is the only property of ContainerDerivedValue.FromHost.
+const hostAddressProperty string = "address"
+
+// extraHosts returns the /etc/hosts entries of a dependency, its own followed by host.docker.internal when
+// the Env has HostAccess.
+func (e *Env) extraHosts(dep Dependency) []string {
+	hosts := append([]string(nil), dep.ExtraHosts...)
+	if e.HostAccess {
+		hosts = append(hosts, hostGatewayName+":"+hostGateway)
+	}
+	return hosts
+}
+
+// hostAddress returns the address of the host as seen from the stack network, its gateway.
+func (s *Stack) hostAddress(ctx context.Context) (string, error) {
+	if s.network == nil {
+		return "", fmt.Errorf("the stack has no network")
+	}
+	return utils.NetworkGateway(ctx, s.network.Name)
+}
@@ -0,0 +1,74 @@
+package gbd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestHostAccess(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+hostAccess: true
+dependencies:
+  - kind: process
+    name: api
+    command: [go, run, .]
+  - image: webhook-sender
+    version: latest
+    name: sender
+    extraHosts: ["mock.local:10.0.0.5"]
+    env:
+      TARGET_URL: 'http://{{ .Address "api" 8080 }}/hooks'
+    replaceConfig:
+      - config_origin_path: /config.yaml
+        replacements:
+          - key: callback.host
+            value: {fromHost: address}
+`), &e))
+	require.Equal(t, []string{"mock.local:10.0.0.5", "host.docker.internal:host-gateway"}, e.extraHosts(e.Dependencies[1]))
+	require.Empty(t, (&Env{}).extraHosts(Dependency{}))
+
+	dv, ok := derivedValue(e.Dependencies[1].ReplaceConfig[0].Replacements[0].Value)
+	require.True(t, ok)
+	require.Equal(t, "address", dv.FromHost)
+	require.True(t, dv.networkAddress())
+	host, ok := e.translateDerivedValue(dv, templateData{})
+	require.True(t, ok)
+	require.Equal(t, "host.docker.internal", host)
+	_, ok = (&Env{}).translateDerivedValue(dv, templateData{})
+	require.False(t, ok)
+
+	data := templateData{deps: e.Dependencies, hostAccess: true}
+	out, err := renderTemplate("url", `{{ .Address "api" 8080 }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, "host.docker.internal:8080", out)
+	data.hostAccess = false
+	_, err = renderTemplate("url", `{{ .Host "api" }}`, data)
+	require.ErrorContains(t, err, "requires hostAccess")
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("callback:\n  host: localhost\n"), 0644))
+	e.ContextDir = dir
+	out = t.TempDir()
+	unresolved, err := e.ExportCompose(out)
+	require.NoError(t, err)
+	require.Contains(t, unresolved, "api: processes on the host are not exported")
+	b, err := os.ReadFile(filepath.Join(out, "docker-compose.yml"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "extra_hosts:\n            - mock.local:10.0.0.5\n            - host.docker.internal:host-gateway\n")
+	require.Contains(t, string(b), "TARGET_URL: http://host.docker.internal:8080/hooks")
+	cfg, err := os.ReadFile(filepath.Join(out, "configs", "sender", "config.yaml"))
+	require.NoError(t, err)
+	require.Contains(t, string(cfg), "host: host.docker.internal")
+
+	_, err = e.ExportScript(out)
+	require.NoError(t, err)
+	b, err = os.ReadFile(filepath.Join(out, exportScriptFile))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "--add-host 'host.docker.internal:host-gateway'")
+}
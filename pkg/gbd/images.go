@@ -0,0 +1,267 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// Pull policies of the dependency images, images built by gbd are not pulled.
+const (
+	PullAlways       string = "always"
+	PullIfNotPresent string = "ifNotPresent"
+	PullNever        string = "never"
+)
+
+// pullPolicy returns the pull policy of a dependency, which defaults to the one of the Env and then to ifNotPresent.
+func (e *Env) pullPolicy(dep Dependency) string {
+	switch {
+	case dep.PullPolicy != "":
+		return dep.PullPolicy
+	case e.PullPolicy != "":
+		return e.PullPolicy
+	}
+	return PullIfNotPresent
+}
+
+// ensureImage applies a pull policy to an image before a container is created from it. Images which are not
+// present are pulled on creation, so ifNotPresent needs no action.
+func ensureImage(ctx context.Context, image, policy string) error {
+	switch policy {
+	case PullAlways:
+		if err := utils.PullImage(ctx, image, registryAuth(ctx, image)); err != nil {
+			return fmt.Errorf("image '%s': %w", image, err)
+		}
+	case PullNever:
+		exists, err := utils.ImageExists(ctx, image)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("image '%s' is not present and the pull policy is never", image)
+		}
+	case PullIfNotPresent:
+	default:
+		return fmt.Errorf("image '%s': unknown pull policy '%s'", image, policy)
+	}
+	return nil
+}
+
+// Images returns the images a stack pulls after the image rewrites, including the one of the testcontainers reaper
+// and the base images of the builds (the FROM lines of their Dockerfile). Images built by gbd are returned
+// separately as they are only available after a build.
+func (e *Env) Images() (pulled []string, built []string, err error) {
+	rules, err := e.imageRewrites()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dep := range e.Dependencies {
+		if dep.isProcess() || dep.isExternal() {
+			continue
+		}
+		if dep.Build != nil {
+			built = append(built, fmt.Sprintf("%s:%s", dep.Image, dep.Version))
+			base, err := dep.Build.baseImages(e.ContextDir)
+			if err != nil {
+				return nil, nil, fmt.Errorf("build '%s': %w", dep.Image, err)
+			}
+			for _, image := range base {
+				if !slices.Contains(pulled, image) {
+					pulled = append(pulled, image)
+				}
+			}
+			continue
+		}
+		pulled = append(pulled, fmt.Sprintf("%s:%s", rewriteImage(rules, dep.Image), dep.Version))
+	}
+	return append(pulled, testcontainers.ReaperDefaultImage), built, nil
+}
+
+// baseImages returns the images of the FROM lines of the Dockerfile of a build, with the ARG defaults declared
+// before them and the build args expanded. Build stages, scratch and images depending on a templated build arg
+// are left out.
+func (b *DockerBuild) baseImages(contextDir string) ([]string, error) {
+	dockerfile := b.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	df, err := os.ReadFile(filepath.Join(b.contextDir(contextDir), dockerfile))
+	if err != nil {
+		return nil, err
+	}
+	return dockerfileBaseImages(string(df), b.BuildArgs), nil
+}
+
+func dockerfileBaseImages(dockerfile string, args map[string]*string) []string {
+	vars := make(map[string]string)
+	stages := make(map[string]bool)
+	var images []string
+	from := false
+	for _, line := range strings.Split(strings.ReplaceAll(dockerfile, "\\\n", " "), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			// only the args declared before the first FROM apply to FROM lines
+			for _, f := range fields[1:] {
+				name, def, hasDefault := strings.Cut(f, "=")
+				switch v, ok := args[name]; {
+				case from:
+				case ok && v == nil:
+					vars[name] = os.Getenv(name)
+				case ok && !strings.Contains(*v, "{{"):
+					vars[name] = *v
+				case !ok && hasDefault:
+					vars[name] = strings.Trim(def, `"'`)
+				}
+			}
+		case "FROM":
+			from = true
+			var rest []string
+			for _, f := range fields[1:] {
+				if !strings.HasPrefix(f, "--") {
+					rest = append(rest, f)
+				}
+			}
+			if len(rest) == 0 {
+				continue
+			}
+			resolved := true
+			image := os.Expand(rest[0], func(name string) string {
+				v, ok := vars[name]
+				resolved = resolved && ok
+				return v
+			})
+			skip := !resolved || image == "scratch" || stages[strings.ToLower(image)]
+			if len(rest) >= 3 && strings.EqualFold(rest[1], "AS") {
+				stages[strings.ToLower(rest[2])] = true
+			}
+			if skip {
+				continue
+			}
+			if !strings.Contains(image, "@") && !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+				image += ":latest"
+			}
+			if !slices.Contains(images, image) {
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
+
+// SaveImages writes the images the stack pulls to a tar archive, so that the stack can start without registry
+// access after LoadImages. Missing images are pulled first, following the pull policies.
+// It returns the images built by gbd, which are not part of the archive.
+func (e *Env) SaveImages(ctx context.Context, archive string) ([]string, error) {
+	pulled, built, err := e.Images()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := e.imageRewrites()
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string]string)
+	for _, dep := range e.Dependencies {
+		if dep.Build == nil && !dep.isProcess() && !dep.isExternal() {
+			policies[fmt.Sprintf("%s:%s", rewriteImage(rules, dep.Image), dep.Version)] = e.pullPolicy(dep)
+		}
+	}
+	for _, image := range pulled {
+		policy := policies[image]
+		if policy == "" {
+			policy = PullIfNotPresent
+		}
+		if err := ensureImage(ctx, image, policy); err != nil {
+			return nil, err
+		}
+		// unlike a container creation, saving does not pull missing images
+		if policy == PullIfNotPresent {
+			exists, err := utils.ImageExists(ctx, image)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				if err := utils.PullImage(ctx, image, registryAuth(ctx, image)); err != nil {
+					return nil, fmt.Errorf("image '%s': %w", image, err)
+				}
+			}
+		}
+	}
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := utils.SaveImages(ctx, pulled, f); err != nil {
+		return nil, err
+	}
+	return built, f.Close()
+}
+
+// loadedArchives are the images archives loaded by Env.Build, by path, with their modification time.
+var loadedArchives = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// loadImagesArchive loads an images archive once per process, rebuilds reuse the loaded images. The archive is
+// not loaded when all of its images are present.
+func loadImagesArchive(ctx context.Context, archive string) error {
+	info, err := os.Stat(archive)
+	if err != nil {
+		return err
+	}
+	loadedArchives.Lock()
+	defer loadedArchives.Unlock()
+	if loaded, ok := loadedArchives.m[archive]; ok && loaded.Equal(info.ModTime()) {
+		return nil
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	images, err := utils.ArchiveImages(f)
+	if err != nil {
+		return err
+	}
+	missing := false
+	for _, image := range images {
+		exists, err := utils.ImageExists(ctx, image)
+		if err != nil {
+			return err
+		}
+		missing = missing || !exists
+	}
+	if missing || len(images) == 0 {
+		if err := LoadImages(ctx, archive); err != nil {
+			return err
+		}
+	}
+	loadedArchives.m[archive] = info.ModTime()
+	return nil
+}
+
+// LoadImages loads the images of an archive written by SaveImages.
+func LoadImages(ctx context.Context, archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return utils.LoadImages(ctx, f)
+}
@@ -0,0 +1,66 @@
+package gbd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestPullPolicy(t *testing.T) {
+	e := &Env{
+		PullPolicy: PullNever,
+		Dependencies: []Dependency{
+			{Image: "postgres", Version: "16"},
+			{Image: "redis", Version: "7", PullPolicy: PullAlways},
+			{Image: "my_service", Version: "latest", Build: &DockerBuild{}},
+		},
+		ContextDir: t.TempDir(),
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(e.ContextDir, "Dockerfile"), []byte("FROM golang:1.21 AS build\nFROM postgres:16\n"), 0644))
+	require.Equal(t, PullNever, e.pullPolicy(e.Dependencies[0]))
+	require.Equal(t, PullAlways, e.pullPolicy(e.Dependencies[1]))
+	require.Equal(t, PullIfNotPresent, (&Env{}).pullPolicy(e.Dependencies[0]))
+	require.Equal(t, "missing", dockerPullPolicy(PullIfNotPresent))
+
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	pulled, built, err := e.Images()
+	require.NoError(t, err)
+	require.Equal(t, []string{"postgres:16", "redis:7", "golang:1.21", testcontainers.ReaperDefaultImage}, pulled)
+	require.Equal(t, []string{"my_service:latest"}, built)
+
+	require.NoError(t, ensureImage(context.Background(), "postgres:16", PullIfNotPresent))
+	require.Error(t, ensureImage(context.Background(), "postgres:16", "sometimes"))
+}
+
+func TestDockerfileBaseImages(t *testing.T) {
+	t.Setenv("DISTRO", "bookworm")
+	version := "1.21"
+	tmpl := "{{ .Values.version }}"
+	df := `# syntax=docker/dockerfile:1
+ARG GO_VERSION=1.20
+ARG DISTRO
+ARG REGISTRY
+ARG RUNTIME="gcr.io/distroless/static"
+FROM --platform=$BUILDPLATFORM golang:${GO_VERSION}-$DISTRO AS build
+FROM build AS test
+FROM node AS assets
+ARG LATE=x
+FROM $REGISTRY/nginx:1.25
+FROM scratch
+FROM \
+  ${RUNTIME}
+COPY --from=build /app /app
+FROM alpine@sha256:c5b1261d6d3e43071626931fc004f70149baeba2c8ec672bd4f27761f8e1ad6b
+FROM node
+`
+	require.Equal(t, []string{
+		"golang:1.21-bookworm",
+		"node:latest",
+		"gcr.io/distroless/static:latest",
+		"alpine@sha256:c5b1261d6d3e43071626931fc004f70149baeba2c8ec672bd4f27761f8e1ad6b",
+	}, dockerfileBaseImages(df, map[string]*string{"GO_VERSION": &version, "DISTRO": nil, "REGISTRY": &tmpl}))
+}
@@ -0,0 +1,97 @@
+package gbd
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// minSecretLength is the length below which values are not masked, masking them would garble unrelated output
+// (ports, flags) without hiding much.
+const minSecretLength = 4
+
+// secretKeyPattern matches the env and replacement keys whose values are masked without an explicit secret marker.
+var secretKeyPattern = regexp.MustCompile(`(?i)(passw(or)?d|passwd|secret|token|api[_-]?key|credential|private[_-]?key)`)
+
+func isSecretKey(key string) bool {
+	return secretKeyPattern.MatchString(key)
+}
+
+// addSecret registers a value to be masked, values that are not scalars are ignored.
+func (s *Stack) addSecret(v any) {
+	switch v.(type) {
+	case map[string]any, []any, nil:
+		return
+	}
+	if str := fmt.Sprint(v); len(str) >= minSecretLength {
+		s.secrets = append(s.secrets, str)
+	}
+}
+
+// masked returns a copy of the Env with the secret env and replacement values masked, for dumping.
+// Derived values and secret sources are references and are kept.
+func (e *Env) masked() *Env {
+	if e.NoMask {
+		return e
+	}
+	out := *e
+	out.Dependencies = make([]Dependency, len(e.Dependencies))
+	for i, dep := range e.Dependencies {
+		if dep.Env != nil {
+			env := make(map[string]string, len(dep.Env))
+			for k, v := range dep.Env {
+				if v != "" && isSecretKey(k) {
+					v = maskedValue
+				}
+				env[k] = v
+			}
+			dep.Env = env
+		}
+		if dep.EnvVars != nil {
+			vars := make(map[string]EnvVar, len(dep.EnvVars))
+			for k, v := range dep.EnvVars {
+				if v.Value != "" && (v.Secret || isSecretKey(k)) {
+					v.Value = maskedValue
+				}
+				vars[k] = v
+			}
+			dep.EnvVars = vars
+		}
+		if dep.Build != nil && (dep.Build.BuildArgs != nil || dep.Build.BuildArgVars != nil) {
+			build := *dep.Build
+			build.BuildArgs = make(map[string]*string, len(dep.Build.BuildArgs))
+			for k, v := range dep.Build.BuildArgs {
+				if v != nil && *v != "" && isSecretKey(k) {
+					masked := maskedValue
+					v = &masked
+				}
+				build.BuildArgs[k] = v
+			}
+			build.BuildArgVars = make(map[string]EnvVar, len(dep.Build.BuildArgVars))
+			for k, v := range dep.Build.BuildArgVars {
+				if v.Value != "" && (v.Secret || isSecretKey(k)) {
+					v.Value = maskedValue
+				}
+				build.BuildArgVars[k] = v
+			}
+			dep.Build = &build
+		}
+		if dep.ReplaceConfig != nil {
+			configs := make([]ConfigReplacement, len(dep.ReplaceConfig))
+			for j, r := range dep.ReplaceConfig {
+				reps := make([]Replacement, len(r.Replacements))
+				for k, rep := range r.Replacements {
+					_, derived := derivedValue(rep.Value)
+					if !derived && rep.Value != nil && (rep.Secret || isSecretKey(rep.Key)) {
+						rep.Value = maskedValue
+					}
+					reps[k] = rep
+				}
+				r.Replacements = reps
+				configs[j] = r
+			}
+			dep.ReplaceConfig = configs
+		}
+		out.Dependencies[i] = dep
+	}
+	return &out
+}
@@ -0,0 +1,75 @@
+package gbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMaskEnv(t *testing.T) {
+	var dep Dependency
+	require.NoError(t, yaml.Unmarshal([]byte(`
+env:
+  POSTGRES_USER: admin
+  POSTGRES_PASSWORD: root-pass
+  LICENSE: {value: abcd-1234, secret: true}
+replaceConfig:
+  - config_origin_path: config.yaml
+    replacements:
+      - key: auth.token
+        value: t0k3n-value
+      - key: db.host
+        value: {fromContainer: db, propertyName: NetworkSettings.IPAddress}
+      - key: api.url
+        value: https://api
+        secret: true
+      - key: server.port
+        value: "8080"
+build:
+  buildArgs:
+    NPM_TOKEN: npm-s3cr3t
+    VERSION: "1.0"
+`), &dep))
+	require.Equal(t, "admin", dep.Env["POSTGRES_USER"])
+	require.Equal(t, EnvVar{Value: "abcd-1234", Secret: true}, dep.EnvVars["LICENSE"])
+	require.NotContains(t, dep.Env, "LICENSE")
+	b, err := yaml.Marshal(dep)
+	require.NoError(t, err)
+	var back Dependency
+	require.NoError(t, yaml.Unmarshal(b, &back))
+	require.Equal(t, dep.Env, back.Env)
+	require.Equal(t, dep.EnvVars, back.EnvVars)
+
+	e := &Env{Dependencies: []Dependency{dep}}
+	b, err = yaml.Marshal(e.masked())
+	require.NoError(t, err)
+	dump := string(b)
+	require.Contains(t, dump, "POSTGRES_USER: admin")
+	require.Contains(t, dump, "8080")
+	require.Contains(t, dump, "fromContainer: db")
+	for _, secret := range []string{"root-pass", "abcd-1234", "t0k3n-value", "https://api", "npm-s3cr3t"} {
+		require.NotContains(t, dump, secret)
+	}
+	// the Env itself is left untouched
+	require.Equal(t, "root-pass", e.Dependencies[0].Env["POSTGRES_PASSWORD"])
+	require.Equal(t, "npm-s3cr3t", *e.Dependencies[0].Build.BuildArgs["NPM_TOKEN"])
+
+	e.NoMask = true
+	b, err = yaml.Marshal(e.masked())
+	require.NoError(t, err)
+	require.Contains(t, string(b), "root-pass")
+
+	require.True(t, isSecretKey("spring.datasource.password"))
+	require.True(t, isSecretKey("GITHUB_TOKEN"))
+	require.True(t, isSecretKey("stripe_api_key"))
+	require.False(t, isSecretKey("server.port"))
+
+	s := &Stack{}
+	s.addSecret("root-pass")
+	s.addSecret("80")
+	s.addSecret(map[string]any{"a": "b"})
+	require.Equal(t, "pass=****** port=80", s.mask("pass=root-pass port=80"))
+	s.noMask = true
+	require.Equal(t, "pass=root-pass", s.mask("pass=root-pass"))
+}
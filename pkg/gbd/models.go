@@ -1,6 +1,9 @@
 package gbd
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 	"gopkg.in/yaml.v3"
@@ -8,6 +11,7 @@ import (
 
 const (
 	networkReplaceId string = "{NETWORK_ID}"
+	maskedValue      string = "******"
 )
 
 type Dependency struct {
@@ -16,44 +20,307 @@ type Dependency struct {
 	Name          string              `yaml:"name,omitempty"`
 	ReplaceConfig []ConfigReplacement `yaml:"replaceConfig,omitempty"`
 	// TODO Parse Replacement and add support for ContainerDerivedValue
-	Env         map[string]string `yaml:"env,omitempty"`
+	Env map[string]string `yaml:"env,omitempty"`
+	// EnvVars are the env entries which are secret or read from a SecretSource, see EnvVar. In yaml they are
+	// written in env as well, they override the entries of Env.
+	EnvVars     map[string]EnvVar `yaml:"-"`
 	Files       []File            `yaml:"files,omitempty"`
 	ExposePorts []string          `yaml:"exposePorts,omitempty"`
 	Alias       string            `yaml:"alias,omitempty"`
 	Build       *DockerBuild      `yaml:"build,omitempty"`
 	WaitFor     WaitFor           `yaml:"waitFor,omitempty"`
+	TLS         *ComponentTLS     `yaml:"tls,omitempty"`
+	// PullPolicy of the image: always, ifNotPresent (default) or never, overrides the one of the Env
+	PullPolicy string `yaml:"pullPolicy,omitempty"`
+	// Kind is container (default), process or external. A process runs Command on the host in WorkingDir
+	// (relative to the context dir) instead of a container, see KindProcess. An external dependency is a running
+	// container selected by External, which the stack uses but never stops, see KindExternal
+	Kind       string             `yaml:"kind,omitempty"`
+	Command    []string           `yaml:"command,omitempty"`
+	WorkingDir string             `yaml:"workingDir,omitempty"`
+	External   *ExternalContainer `yaml:"external,omitempty"`
+	// ExtraHosts are added to /etc/hosts of the container as host:ip, the ip may be host-gateway
+	ExtraHosts []string `yaml:"extraHosts,omitempty"`
+	// Networks joined by the container, the first network of the Env when empty
+	Networks DependencyNetworks `yaml:"networks,omitempty"`
+	// Replicas runs several instances of the container named <name>-<index>, {{ .Index }} in their templates
+	Replicas int `yaml:"replicas,omitempty"`
+	// Restart is the restart policy of the container after a crash: no (default), always or on-failure[:max retries]
+	Restart string `yaml:"restart,omitempty"`
+
+	// replica is set on the replicas of a dependency, see expandReplicas
+	replica *replicaOf
+}
+
+func (d *Dependency) UnmarshalYAML(value *yaml.Node) error {
+	type plain Dependency
+	rest, env := cutMappingEntry(value, "env")
+	if err := rest.Decode((*plain)(d)); err != nil {
+		return err
+	}
+	if env == nil {
+		return nil
+	}
+	var vars map[string]EnvVar
+	if err := env.Decode(&vars); err != nil {
+		return err
+	}
+	d.Env, d.EnvVars = splitEnvVars(vars)
+	return nil
+}
+
+func (d Dependency) MarshalYAML() (any, error) {
+	type plain Dependency
+	return encodeWithEntry(plain(d), "env", d.envVars(), len(d.EnvVars) > 0)
+}
+
+// envVars returns the entries of Env and EnvVars.
+func (d Dependency) envVars() map[string]EnvVar {
+	return mergeEnvVars(d.Env, d.EnvVars)
+}
+
+// isProcess reports whether the dependency runs on the host instead of a container.
+func (d Dependency) isProcess() bool {
+	return d.Kind == KindProcess
+}
+
+// isExternal reports whether the dependency is a running container that the stack does not own.
+func (d Dependency) isExternal() bool {
+	return d.Kind == KindExternal
+}
+
+// EnvVar is the value of an environment variable, written either as a plain string or as {value, secret},
+// {file: path} or {secretRef: name} (see SecretSource).
+// Secret values, as well as the ones of keys that look like secrets (see isSecretKey), are masked in the output of gbd.
+type EnvVar struct {
+	Value        string `yaml:"value,omitempty"`
+	Secret       bool   `yaml:"secret,omitempty"`
+	SecretSource `yaml:",inline"`
+}
+
+func (v *EnvVar) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		v.Value = value.Value
+		return nil
+	}
+	type plain EnvVar
+	return value.Decode((*plain)(v))
+}
+
+func (v EnvVar) MarshalYAML() (any, error) {
+	if !v.Secret && !v.isSet() {
+		return v.Value, nil
+	}
+	type plain EnvVar
+	return plain(v), nil
+}
+
+// splitEnvVars splits env entries into plain values and the ones which are secret or read from a SecretSource.
+func splitEnvVars(vars map[string]EnvVar) (map[string]string, map[string]EnvVar) {
+	var plain map[string]string
+	var secret map[string]EnvVar
+	for k, v := range vars {
+		if !v.Secret && !v.isSet() {
+			if plain == nil {
+				plain = make(map[string]string)
+			}
+			plain[k] = v.Value
+			continue
+		}
+		if secret == nil {
+			secret = make(map[string]EnvVar)
+		}
+		secret[k] = v
+	}
+	return plain, secret
+}
+
+func mergeEnvVars(plain map[string]string, secret map[string]EnvVar) map[string]EnvVar {
+	if len(plain) == 0 && len(secret) == 0 {
+		return nil
+	}
+	vars := make(map[string]EnvVar, len(plain)+len(secret))
+	for k, v := range plain {
+		vars[k] = EnvVar{Value: v}
+	}
+	for k, v := range secret {
+		vars[k] = v
+	}
+	return vars
 }
 
-type DockerBuild struct {
-	Dockerfile string             `yaml:"dockerfile"`
-	BuildArgs  map[string]*string `yaml:"buildArgs"`
-	BuildLog   bool               `yaml:"buildLog"`
+// cutMappingEntry returns a copy of a mapping node without the entry key, and the value of that entry.
+func cutMappingEntry(value *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if value.Kind != yaml.MappingNode {
+		return value, nil
+	}
+	rest := *value
+	rest.Content = nil
+	var entry *yaml.Node
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if value.Content[i].Value == key {
+			entry = value.Content[i+1]
+			continue
+		}
+		rest.Content = append(rest.Content, value.Content[i], value.Content[i+1])
+	}
+	return &rest, entry
+}
+
+// encodeWithEntry encodes v as a mapping node, with the value of key replaced by entry when replace is set.
+func encodeWithEntry(v any, key string, entry any, replace bool) (any, error) {
+	if !replace {
+		return v, nil
+	}
+	var node, entryNode yaml.Node
+	if err := node.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := entryNode.Encode(entry); err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = &entryNode
+			return &node, nil
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, &entryNode)
+	return &node, nil
 }
 
-// ConfigReplacement is a struct that represents a key/value pair that will be replaced in the config file
-// Key can be a dot separated path to the value if it is nested
+// ConfigReplacement is a struct that represents a set of replacements that will be applied to a config file.
+// The codec of the file is looked up by its extension unless Format names one, see RegisterConfigCodec.
+// With FromImage the ConfigOriginPath is a path inside the image of the dependency (pulled or built) instead of
+// the context dir, TargetPath then defaults to the same path.
 type ConfigReplacement struct {
 	ConfigOriginPath string        `yaml:"config_origin_path,omitempty"`
 	TargetPath       string        `yaml:"target_path,omitempty"`
+	FromImage        bool          `yaml:"fromImage,omitempty"`
+	Format           string        `yaml:"format,omitempty"`
 	Replacements     []Replacement `yaml:"replacements,omitempty"`
-	hostFile         string        `yaml:"host_file,omitempty"`
+	// rendered is the replaced config, kept in memory until it is copied into the container
+	rendered []byte
+}
+
+func (r ConfigReplacement) targetPath() string {
+	if r.TargetPath == "" && r.FromImage {
+		return r.ConfigOriginPath
+	}
+	return r.TargetPath
 }
 
+// Replacement sets Value at Key. For yaml and json Key is a dot separated path which supports list indices (servers[0].host),
+// wildcards (brokers.*.address) and quoted or escaped segments for keys containing dots ("spring.datasource.url").
+// Properties and env keys are taken literally, ini keys are 'section.key' and xml keys are XPath like
+// (/Configuration/Loggers/Logger[@name='app']/@level).
+// When CreateMissing is set, missing intermediate keys (sections, elements) are created instead of failing.
+//
+// Op selects what happens at Key: set (default), setIfAbsent, delete, append (to a list) or merge (a map).
+// Type optionally coerces Value to string, int, float or bool before it is applied.
+// Secret masks the value in the output of gbd, keys that look like secrets are masked without it.
+// Source reads the value from a SecretSource instead, source: {file: path} or source: {secretRef: name}.
 type Replacement struct {
-	Key   string `yaml:"key"`
-	Value any    `yaml:"value"`
+	Key           string        `yaml:"key"`
+	Value         any           `yaml:"value,omitempty"`
+	Source        *SecretSource `yaml:"source,omitempty"`
+	Op            string        `yaml:"op,omitempty"`
+	Type          string        `yaml:"type,omitempty"`
+	CreateMissing bool          `yaml:"createMissing,omitempty"`
+	Secret        bool          `yaml:"secret,omitempty"`
 }
 
+// File is copied into the container at TargetPath, either from HostFilePath or from Content.
+// Content is rendered as a go template (e.g. {{ .Values.jwt.PublicKey }}) when Template is set.
 type File struct {
 	TargetPath   string `yaml:"targetPath"`
 	Mode         int64  `yaml:"mode"`
 	Content      []byte `yaml:"content,omitempty"`
 	HostFilePath string `yaml:"hostFilePath,omitempty"`
+	Template     bool   `yaml:"template,omitempty"`
 }
 
+// ContainerDerivedValue is a value taken from a previously started container of the stack:
+//   - fromContainer: a JSONPath (propertyName) into the docker inspect JSON of the container
+//   - fromLogs: the first match of regex in the logs of the container, group selects the capture group (default 1)
+//   - fromExec: the stdout of command executed in the container
+//   - fromFile: the content of the file at path inside the container
+//   - fromTLS: a property (propertyName) of the certificate issued for the component, see Certificate
+//   - fromHost: address, the address of the host as seen from the stack network (its gateway)
+//
+// The output of fromExec and fromFile is trimmed, or when jsonPath is set parsed as JSON and queried.
 type ContainerDerivedValue struct {
-	FromContainer         string `yaml:"fromContainer"`
-	ContainerPropertyPath string `yaml:"propertyName"`
+	FromContainer         string   `yaml:"fromContainer,omitempty"`
+	ContainerPropertyPath string   `yaml:"propertyName,omitempty"`
+	FromLogs              string   `yaml:"fromLogs,omitempty"`
+	Regex                 string   `yaml:"regex,omitempty"`
+	Group                 *int     `yaml:"group,omitempty"`
+	FromExec              string   `yaml:"fromExec,omitempty"`
+	Command               []string `yaml:"command,omitempty"`
+	FromFile              string   `yaml:"fromFile,omitempty"`
+	Path                  string   `yaml:"path,omitempty"`
+	JSONPath              string   `yaml:"jsonPath,omitempty"`
+	FromTLS               string   `yaml:"fromTLS,omitempty"`
+	FromHost              string   `yaml:"fromHost,omitempty"`
+}
+
+// derivedValueSources are the keys which mark a map as a ContainerDerivedValue.
+var derivedValueSources = []string{"fromContainer", "fromLogs", "fromExec", "fromFile", "fromTLS", "fromHost"}
+
+// component returns the name of the container the value is derived from.
+func (dv *ContainerDerivedValue) component() string {
+	switch {
+	case dv.FromLogs != "":
+		return dv.FromLogs
+	case dv.FromExec != "":
+		return dv.FromExec
+	case dv.FromFile != "":
+		return dv.FromFile
+	case dv.FromTLS != "":
+		return dv.FromTLS
+	}
+	return dv.FromContainer
+}
+
+func (dv *ContainerDerivedValue) String() string {
+	switch {
+	case dv.FromLogs != "":
+		return fmt.Sprintf("logs of container '%s' matching '%s'", dv.FromLogs, dv.Regex)
+	case dv.FromExec != "":
+		return fmt.Sprintf("output of '%s' in container '%s'", strings.Join(dv.Command, " "), dv.FromExec)
+	case dv.FromFile != "":
+		return fmt.Sprintf("file '%s' of container '%s'", dv.Path, dv.FromFile)
+	case dv.FromTLS != "":
+		return fmt.Sprintf("'%s' of the certificate of '%s'", dv.ContainerPropertyPath, dv.FromTLS)
+	case dv.FromHost != "":
+		return fmt.Sprintf("'%s' of the host", dv.FromHost)
+	}
+	return fmt.Sprintf("'%s' of container '%s'", dv.ContainerPropertyPath, dv.FromContainer)
+}
+
+// derivedValue reports whether a replacement value refers to a container, either
+// as a ContainerDerivedValue or as its decoded yaml map form.
+func derivedValue(v any) (*ContainerDerivedValue, bool) {
+	switch dv := v.(type) {
+	case *ContainerDerivedValue:
+		return dv, true
+	case map[string]any:
+		for _, src := range derivedValueSources {
+			if _, ok := dv[src].(string); !ok {
+				continue
+			}
+			b, err := yaml.Marshal(dv)
+			if err != nil {
+				return nil, false
+			}
+			var cdv ContainerDerivedValue
+			if err := yaml.Unmarshal(b, &cdv); err != nil {
+				return nil, false
+			}
+			return &cdv, true
+		}
+	}
+	return nil, false
 }
 
 // WaitFor is a struct that represents a wait strategy for a container.
@@ -104,15 +371,22 @@ func (w *WaitFor) UnmarshalYAML(value *yaml.Node) error {
 
 type StackComponent struct {
 	container      testcontainers.Container `yaml:"-"`
-	ContainerId    string                   `yaml:"containerId"`
-	Name           string                   `yaml:"name"`
-	Image          string                   `yaml:"image"`
-	Version        string                   `yaml:"version"`
-	Networks       []string                 `yaml:"networks"`
-	NetworkAliases map[string][]string      `yaml:"networkAliases"`
-	InternalIP     string                   `yaml:"internalIP"`
-	Ports          map[string][]PortRef     `yaml:"ports"`
-	MappedPorts    map[string]string        `yaml:"mappedPorts"`
+	process        *hostProcess
+	Kind           string               `yaml:"kind,omitempty"`
+	Pid            int                  `yaml:"pid,omitempty"`
+	ContainerId    string               `yaml:"containerId"`
+	Name           string               `yaml:"name"`
+	ContainerName  string               `yaml:"containerName,omitempty"`
+	Image          string               `yaml:"image"`
+	Version        string               `yaml:"version"`
+	Networks       []string             `yaml:"networks"`
+	NetworkAliases map[string][]string  `yaml:"networkAliases"`
+	InternalIP     string               `yaml:"internalIP"`
+	Ports          map[string][]PortRef `yaml:"ports"`
+	MappedPorts    map[string]string    `yaml:"mappedPorts"`
+	// Group is the name of the dependency of a replica, Index its index
+	Group string `yaml:"group,omitempty"`
+	Index int    `yaml:"index,omitempty"`
 }
 
 type PortRef struct {
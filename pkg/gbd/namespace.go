@@ -0,0 +1,53 @@
+package gbd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+// Labels of the containers and networks of a stack: its ID, the logical name of the dependency and the index
+// of a replica.
+const (
+	stackLabel      string = "gbd.stack"
+	dependencyLabel string = "gbd.dependency"
+	replicaLabel    string = "gbd.replica"
+)
+
+// stackIDPattern is what docker accepts at the start of a container name.
+var stackIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// stackID returns Env.StackID, or a random ID so that concurrent stacks on a docker host never collide.
+func (e *Env) stackID() (string, error) {
+	if e.StackID != "" {
+		if !stackIDPattern.MatchString(e.StackID) {
+			return "", fmt.Errorf("stackId: '%s' is not a valid container name prefix", e.StackID)
+		}
+		return e.StackID, nil
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ID returns the ID of the stack, the prefix of the names of its containers and the value of their gbd.stack label.
+func (s *Stack) ID() string {
+	return s.id
+}
+
+// containerName returns the docker name of the container of a dependency.
+func (s *Stack) containerName(name string) string {
+	return s.id + "-" + name
+}
+
+// labels returns the labels of a container of the stack, or of a network when name is empty.
+func (s *Stack) labels(name string) map[string]string {
+	labels := map[string]string{stackLabel: s.id}
+	if name != "" {
+		labels[dependencyLabel] = name
+	}
+	return labels
+}
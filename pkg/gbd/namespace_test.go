@@ -0,0 +1,30 @@
+package gbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStackID(t *testing.T) {
+	id, err := (&Env{StackID: "ci-42"}).stackID()
+	require.NoError(t, err)
+	require.Equal(t, "ci-42", id)
+	_, err = (&Env{StackID: "-ci"}).stackID()
+	require.ErrorContains(t, err, "not a valid container name prefix")
+
+	a, err := (&Env{}).stackID()
+	require.NoError(t, err)
+	b, err := (&Env{}).stackID()
+	require.NoError(t, err)
+	require.Len(t, a, 8)
+	require.NotEqual(t, a, b)
+
+	s := &Stack{id: "ci-42", components: []StackComponent{{Name: "db", ContainerName: "ci-42-db"}}}
+	require.Equal(t, "ci-42-db", s.containerName("db"))
+	require.Equal(t, map[string]string{stackLabel: "ci-42", dependencyLabel: "db"}, s.labels("db"))
+	require.Equal(t, map[string]string{stackLabel: "ci-42"}, s.labels(""))
+	cmp, err := s.GetComponent("db")
+	require.NoError(t, err)
+	require.Equal(t, "ci-42-db", cmp.ContainerName)
+}
@@ -0,0 +1,161 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+
+	dnetwork "github.com/docker/docker/api/types/network"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// defaultNetwork is the name of the network of an Env which declares none.
+const defaultNetwork string = "gbd"
+
+// NetworkConfig is a network of the stack. Networks are created for every Build with a random docker name,
+// Name identifies them in the config. Internal networks have no egress.
+// An External network is an existing docker network named Name, joined rather than created and never removed.
+type NetworkConfig struct {
+	Name     string            `yaml:"name"`
+	External bool              `yaml:"external,omitempty"`
+	Driver   string            `yaml:"driver,omitempty"`
+	Internal bool              `yaml:"internal,omitempty"`
+	IPv6     bool              `yaml:"ipv6,omitempty"`
+	Subnet   string            `yaml:"subnet,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty"`
+}
+
+// DependencyNetworks are the networks a dependency joins by name, with their aliases next to Dependency.Alias.
+// They are written as a map of network names to aliases or as a list of network names.
+type DependencyNetworks map[string][]string
+
+func (n *DependencyNetworks) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var names []string
+		if err := value.Decode(&names); err != nil {
+			return err
+		}
+		*n = make(DependencyNetworks, len(names))
+		for _, name := range names {
+			(*n)[name] = nil
+		}
+		return nil
+	}
+	var m map[string][]string
+	if err := value.Decode(&m); err != nil {
+		return err
+	}
+	*n = m
+	return nil
+}
+
+// networkAttachment is a network joined by a dependency with its aliases.
+type networkAttachment struct {
+	name    string
+	aliases []string
+}
+
+// networkConfigs returns the networks of the Env, the first one is the default network of the dependencies.
+// Env.Network is an external network placed first.
+func (e *Env) networkConfigs() ([]NetworkConfig, error) {
+	var configs []NetworkConfig
+	if e.Network != "" {
+		configs = append(configs, NetworkConfig{Name: e.Network, External: true})
+	}
+	configs = append(configs, e.Networks...)
+	if len(configs) == 0 {
+		return []NetworkConfig{{Name: defaultNetwork}}, nil
+	}
+	names := make(map[string]bool)
+	for _, nc := range configs {
+		if nc.Name == "" {
+			return nil, fmt.Errorf("networks: a network requires a name")
+		}
+		if names[nc.Name] {
+			return nil, fmt.Errorf("networks: duplicate network '%s'", nc.Name)
+		}
+		names[nc.Name] = true
+		if nc.External && (nc.Driver != "" || nc.Internal || nc.IPv6 || nc.Subnet != "" || len(nc.Labels) > 0) {
+			return nil, fmt.Errorf("networks: external network '%s' is not configured by gbd", nc.Name)
+		}
+	}
+	return configs, nil
+}
+
+// dependencyNetworks returns the networks a dependency joins in the order of the Env networks, the default
+// network when it names none. Replicas are aliased with the alias and name of their dependency as well.
+func dependencyNetworks(dep Dependency, configs []NetworkConfig) ([]networkAttachment, error) {
+	aliases := func(extra []string) []string {
+		var out []string
+		seen := make(map[string]bool)
+		all := append([]string{dep.Alias}, extra...)
+		if dep.replica != nil {
+			all = append(all, dep.replica.alias, dep.replica.name)
+		}
+		for _, a := range all {
+			if a != "" && !seen[a] {
+				seen[a] = true
+				out = append(out, a)
+			}
+		}
+		return out
+	}
+	if len(dep.Networks) == 0 {
+		return []networkAttachment{{name: configs[0].Name, aliases: aliases(nil)}}, nil
+	}
+	known := make(map[string]bool, len(configs))
+	for _, nc := range configs {
+		known[nc.Name] = true
+	}
+	for _, name := range sortedKeys(dep.Networks) {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown network '%s'", name)
+		}
+	}
+	var attachments []networkAttachment
+	for _, nc := range configs {
+		if extra, ok := dep.Networks[nc.Name]; ok {
+			attachments = append(attachments, networkAttachment{name: nc.Name, aliases: aliases(extra)})
+		}
+	}
+	return attachments, nil
+}
+
+// create creates the network with the labels of the stack, labeled to be removed by the reaper as well.
+// External networks are looked up instead.
+func (nc NetworkConfig) create(ctx context.Context, labels map[string]string) (*testcontainers.DockerNetwork, error) {
+	if nc.External {
+		nw, err := utils.InspectNetwork(ctx, nc.Name)
+		if err != nil {
+			return nil, fmt.Errorf("network '%s': %w", nc.Name, err)
+		}
+		return &testcontainers.DockerNetwork{ID: nw.ID, Driver: nw.Driver, Name: nw.Name}, nil
+	}
+	var opts []network.NetworkCustomizer
+	if nc.Driver != "" {
+		opts = append(opts, network.WithDriver(nc.Driver))
+	}
+	if nc.Internal {
+		opts = append(opts, network.WithInternal())
+	}
+	if nc.IPv6 {
+		opts = append(opts, network.WithEnableIPv6())
+	}
+	if nc.Subnet != "" {
+		opts = append(opts, network.WithIPAM(&dnetwork.IPAM{Config: []dnetwork.IPAMConfig{{Subnet: nc.Subnet}}}))
+	}
+	if len(nc.Labels) > 0 {
+		opts = append(opts, network.WithLabels(nc.Labels))
+	}
+	if len(labels) > 0 {
+		opts = append(opts, network.WithLabels(labels))
+	}
+	nw, err := network.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("network '%s': %w", nc.Name, err)
+	}
+	return nw, nil
+}
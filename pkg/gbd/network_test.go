@@ -0,0 +1,92 @@
+package gbd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNetworks(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+networks:
+  - name: frontend
+  - name: backend
+    internal: true
+    subnet: 172.28.0.0/16
+    labels: {team: core}
+dependencies:
+  - image: postgres
+    version: latest
+    name: db
+    alias: pgtc
+    networks: [backend]
+  - image: api
+    version: latest
+    name: api
+    alias: api
+    networks:
+      backend: [api-internal]
+      frontend: []
+  - image: proxy
+    version: latest
+    name: proxy
+`), &e))
+	configs, err := e.networkConfigs()
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+
+	db, err := dependencyNetworks(e.Dependencies[0], configs)
+	require.NoError(t, err)
+	require.Equal(t, []networkAttachment{{name: "backend", aliases: []string{"pgtc"}}}, db)
+	api, err := dependencyNetworks(e.Dependencies[1], configs)
+	require.NoError(t, err)
+	require.Equal(t, []networkAttachment{
+		{name: "frontend", aliases: []string{"api"}},
+		{name: "backend", aliases: []string{"api", "api-internal"}},
+	}, api)
+	proxy, err := dependencyNetworks(e.Dependencies[2], configs)
+	require.NoError(t, err)
+	require.Equal(t, []networkAttachment{{name: "frontend", aliases: nil}}, proxy)
+
+	_, err = dependencyNetworks(Dependency{Networks: DependencyNetworks{"dmz": nil}}, configs)
+	require.ErrorContains(t, err, "unknown network 'dmz'")
+	_, err = (&Env{Networks: []NetworkConfig{{Name: "a"}, {Name: "a"}}}).networkConfigs()
+	require.ErrorContains(t, err, "duplicate network")
+	configs, err = (&Env{}).networkConfigs()
+	require.NoError(t, err)
+	require.Equal(t, []NetworkConfig{{Name: defaultNetwork}}, configs)
+
+	e.ContextDir = t.TempDir()
+	out := t.TempDir()
+	_, err = e.ExportCompose(out)
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(out, "docker-compose.yml"))
+	require.NoError(t, err)
+	var cf composeFile
+	require.NoError(t, yaml.Unmarshal(b, &cf))
+	require.Equal(t, composeNetwork{
+		Driver:   "bridge",
+		Internal: true,
+		IPAM:     &composeIPAM{Config: []composeIPAMConfig{{Subnet: "172.28.0.0/16"}}},
+		Labels:   map[string]string{"team": "core"},
+	}, cf.Networks["backend"])
+	require.Equal(t, map[string]composeServiceNetwork{
+		"frontend": {Aliases: []string{"api"}},
+		"backend":  {Aliases: []string{"api", "api-internal"}},
+	}, cf.Services["api"].Networks)
+
+	_, err = e.ExportScript(out)
+	require.NoError(t, err)
+	b, err = os.ReadFile(filepath.Join(out, exportScriptFile))
+	require.NoError(t, err)
+	script := string(b)
+	require.Contains(t, script, "docker network create --internal --subnet '172.28.0.0/16' --label 'team=core' 'backend' >/dev/null\n")
+	require.Contains(t, script, "docker create \\\n  --name 'api' \\\n  --network 'frontend' \\\n  --pull missing \\\n  --network-alias 'api'")
+	require.Contains(t, script, "docker network connect --alias 'api' --alias 'api-internal' 'backend' 'api'\ndocker start 'api' >/dev/null\n")
+	require.Contains(t, script, "docker run -d \\\n  --name 'db' \\\n  --network 'backend' \\\n")
+}
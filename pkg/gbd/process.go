@@ -0,0 +1,434 @@
+package gbd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+	tcexec "github.com/testcontainers/testcontainers-go/exec"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// Kinds of dependencies, see Dependency.Kind.
+const (
+	KindContainer string = "container"
+	KindProcess   string = "process"
+	KindExternal  string = "external"
+)
+
+// processStopTimeout is how long a process is given to exit after it is interrupted, before it is killed.
+const processStopTimeout = 5 * time.Second
+
+// processOutputLimit is the size of the output of a process kept for wait strategies and derived values.
+const processOutputLimit = 1 << 20
+
+// processPortTimeout is how long the port wait strategy of a process waits by default.
+const processPortTimeout = 60 * time.Second
+
+// hostProcess is a dependency run as a process on the host, e.g. the service under development started with
+// 'go run'. Its output is streamed to stdout and its last processOutputLimit bytes are kept for wait strategies
+// and derived values. It implements wait.StrategyTarget, ports are the same on the host and in the process.
+type hostProcess struct {
+	name  string
+	cmd   *exec.Cmd
+	ports []string
+	// files are the rendered configs and files written for the process, removed with filesDir when it is stopped
+	files    []string
+	filesDir string
+
+	mu       sync.Mutex
+	output   tailBuffer
+	stopping bool
+	done     chan struct{}
+}
+
+// startProcess starts a dependency of kind process. Its configs and files are written to a temp dir owned by gbd,
+// see templateData.Files, and its replacements resolve to host reachable addresses (see templateData.Host).
+func (s *Stack) startProcess(ctx context.Context, dep Dependency, env map[string]string, data templateData) (StackComponent, error) {
+	if dep.Name == "" {
+		return StackComponent{}, fmt.Errorf("a process requires a name")
+	}
+	if len(dep.Command) == 0 {
+		return StackComponent{}, fmt.Errorf("%s: a process requires a command", dep.Name)
+	}
+	if dep.TLS != nil {
+		return StackComponent{}, fmt.Errorf("%s: tls is not supported for processes", dep.Name)
+	}
+	if dep.Restart != "" {
+		return StackComponent{}, fmt.Errorf("%s: restart is not supported for processes", dep.Name)
+	}
+
+	files, err := os.MkdirTemp("", "gbd-"+dep.Name+"-")
+	if err != nil {
+		return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+	}
+	p := &hostProcess{
+		name:     dep.Name,
+		ports:    dep.ExposePorts,
+		filesDir: files,
+		output:   tailBuffer{limit: processOutputLimit},
+		done:     make(chan struct{}),
+	}
+	data.Files = files
+
+	command := make([]string, len(dep.Command))
+	for i, arg := range dep.Command {
+		r, err := renderTemplate(dep.Name, arg, data)
+		if err != nil {
+			p.removeFiles()
+			return StackComponent{}, fmt.Errorf("%s: command: %w", dep.Name, err)
+		}
+		command[i] = r
+	}
+	dir := s.workDir
+	if dep.WorkingDir != "" {
+		dir = dep.WorkingDir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(s.workDir, dir)
+		}
+	}
+
+	if err := s.writeProcessFiles(ctx, p, dep, data); err != nil {
+		p.removeFiles()
+		return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+	}
+
+	p.cmd = exec.Command(command[0], command[1:]...)
+	p.cmd.Dir = dir
+	p.cmd.Env = append(os.Environ(), "GBD_FILES_DIR="+files)
+	for _, k := range sortedKeys(env) {
+		p.cmd.Env = append(p.cmd.Env, k+"="+env[k])
+	}
+	out := &processOutput{p: p, mask: s.mask}
+	p.cmd.Stdout = out
+	p.cmd.Stderr = out
+	setProcessGroup(p.cmd)
+	if err := p.cmd.Start(); err != nil {
+		p.removeFiles()
+		return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+	}
+	fmt.Printf("Started process '%s' (pid %d): %s\n", dep.Name, p.cmd.Process.Pid, s.mask(strings.Join(command, " ")))
+	go p.supervise()
+
+	if str, ok := dep.WaitFor.WaitForStrategy.(*wait.HostPortStrategy); ok {
+		if err := p.waitForPort(ctx, str); err != nil {
+			_ = p.stop()
+			return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+		}
+	} else if dep.WaitFor.WaitForStrategy != nil {
+		if err := dep.WaitFor.WaitForStrategy.WaitUntilReady(ctx, p); err != nil {
+			_ = p.stop()
+			return StackComponent{}, fmt.Errorf("%s: %w", dep.Name, err)
+		}
+	}
+
+	mapped := make(map[string]string, len(dep.ExposePorts))
+	for _, port := range dep.ExposePorts {
+		mapped[port] = nat.Port(port).Port()
+	}
+	return StackComponent{
+		process:     p,
+		Kind:        KindProcess,
+		Name:        dep.Name,
+		Pid:         p.cmd.Process.Pid,
+		MappedPorts: mapped,
+	}, nil
+}
+
+// writeProcessFiles renders the configs and files of a process and writes them relative to its files dir.
+// Rendered configs may hold secrets, they are only readable by the user and removed when the process stops.
+// Files on absolute paths are never overwritten, so that host and checked in configs are left alone.
+func (s *Stack) writeProcessFiles(ctx context.Context, p *hostProcess, dep Dependency, data templateData) error {
+	for _, r := range dep.ReplaceConfig {
+		if r.FromImage {
+			return fmt.Errorf("'%s': fromImage is not supported for processes", r.ConfigOriginPath)
+		}
+	}
+	if err := s.replaceConfigs(ctx, dep.ReplaceConfig, "", data); err != nil {
+		return err
+	}
+	for _, r := range dep.ReplaceConfig {
+		target := hostPath(p.filesDir, r.targetPath())
+		if target == filepath.Clean(s.workDir+r.ConfigOriginPath) {
+			return fmt.Errorf("'%s': the target path of a process config must differ from its origin", r.ConfigOriginPath)
+		}
+		if err := p.writeFile(target, r.rendered, 0600); err != nil {
+			return err
+		}
+	}
+	for _, file := range dep.Files {
+		content := file.Content
+		if file.HostFilePath != "" {
+			b, err := os.ReadFile(file.HostFilePath)
+			if err != nil {
+				return err
+			}
+			content = b
+		} else if file.Template {
+			rendered, err := renderTemplate(file.TargetPath, string(content), data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.TargetPath, err)
+			}
+			content = []byte(rendered)
+		}
+		mode := os.FileMode(file.Mode)
+		if mode == 0 {
+			mode = 0600
+		}
+		if err := p.writeFile(hostPath(p.filesDir, file.TargetPath), content, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostPath resolves the target path of a process file against its files dir.
+func hostPath(dir, target string) string {
+	if filepath.IsAbs(target) {
+		return filepath.Clean(target)
+	}
+	return filepath.Join(dir, target)
+}
+
+// writeFile creates a file of the process, failing when it exists already.
+func (p *hostProcess) writeFile(path string, content []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("'%s' exists already, gbd does not overwrite host files", path)
+	}
+	if err != nil {
+		return err
+	}
+	p.files = append(p.files, path)
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// removeFiles removes the files written for the process and its files dir.
+func (p *hostProcess) removeFiles() {
+	for _, f := range p.files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+	}
+	p.files = nil
+	if p.filesDir != "" {
+		if err := os.RemoveAll(p.filesDir); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// supervise waits for the process and reports when it exits without being stopped by gbd.
+func (p *hostProcess) supervise() {
+	err := p.cmd.Wait()
+	p.mu.Lock()
+	stopping := p.stopping
+	p.mu.Unlock()
+	close(p.done)
+	switch {
+	case stopping:
+	case err != nil:
+		fmt.Printf("Process '%s' exited: %v\n", p.name, err)
+	default:
+		fmt.Printf("Process '%s' exited\n", p.name)
+	}
+}
+
+// stop interrupts the process and its children, kills them when they do not exit in time and removes the
+// files written for the process.
+func (p *hostProcess) stop() error {
+	defer p.removeFiles()
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	if err := interruptProcess(p.cmd); err != nil {
+		return err
+	}
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(processStopTimeout):
+		if err := killProcess(p.cmd); err != nil {
+			return err
+		}
+		<-p.done
+		return nil
+	}
+}
+
+// waitForPort waits until the port of the strategy, the first exposed port by default, accepts connections on
+// the host. The strategy of testcontainers also checks the port from inside the container, with Exec.
+func (p *hostProcess) waitForPort(ctx context.Context, str *wait.HostPortStrategy) error {
+	timeout := processPortTimeout
+	if t := str.Timeout(); t != nil {
+		timeout = *t
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	port := str.Port
+	if port == "" && len(p.ports) > 0 {
+		port = nat.Port(p.ports[0])
+	}
+	if port.Port() == "" {
+		return fmt.Errorf("port wait strategy: no port to wait for")
+	}
+	proto := port.Proto()
+	if !strings.Contains(string(port), "/") {
+		proto = "tcp"
+	}
+	interval := str.PollInterval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	var dialer net.Dialer
+	for {
+		if p.exited() {
+			return fmt.Errorf("process exited before port %s was ready", port.Port())
+		}
+		conn, err := dialer.DialContext(ctx, proto, net.JoinHostPort("localhost", port.Port()))
+		if err == nil {
+			return conn.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("port %s is not ready after %s: %w", port.Port(), timeout, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (p *hostProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *hostProcess) Host(context.Context) (string, error) {
+	return "localhost", nil
+}
+
+func (p *hostProcess) Ports(context.Context) (nat.PortMap, error) {
+	ports := make(nat.PortMap, len(p.ports))
+	for _, port := range p.ports {
+		np := nat.Port(port)
+		if !strings.Contains(port, "/") {
+			np = nat.Port(port + "/tcp")
+		}
+		ports[np] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: np.Port()}}
+	}
+	return ports, nil
+}
+
+func (p *hostProcess) MappedPort(_ context.Context, port nat.Port) (nat.Port, error) {
+	return port, nil
+}
+
+func (p *hostProcess) Logs(context.Context) (io.ReadCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(p.output.Bytes())), nil
+}
+
+// Exec is not supported, a process has no container to execute commands in. Port wait strategies are run by
+// waitForPort instead.
+func (p *hostProcess) Exec(context.Context, []string, ...tcexec.ProcessOption) (int, io.Reader, error) {
+	return 0, nil, fmt.Errorf("exec is not supported for process '%s'", p.name)
+}
+
+func (p *hostProcess) State(context.Context) (*types.ContainerState, error) {
+	if !p.exited() {
+		return &types.ContainerState{Status: "running", Running: true, Pid: p.cmd.Process.Pid}, nil
+	}
+	return &types.ContainerState{Status: "exited", ExitCode: p.cmd.ProcessState.ExitCode()}, nil
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	data  []byte
+	// next is the position of the oldest byte once the buffer is full
+	next int
+	full bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= b.limit {
+		b.data = append(b.data[:0], p[len(p)-b.limit:]...)
+		b.next, b.full = 0, true
+		return n, nil
+	}
+	if !b.full {
+		room := b.limit - len(b.data)
+		if len(p) < room {
+			b.data = append(b.data, p...)
+			return n, nil
+		}
+		b.data = append(b.data, p[:room]...)
+		p = p[room:]
+		b.next, b.full = 0, true
+	}
+	for len(p) > 0 {
+		c := copy(b.data[b.next:], p)
+		p = p[c:]
+		b.next = (b.next + c) % b.limit
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the content of the buffer, oldest first.
+func (b *tailBuffer) Bytes() []byte {
+	return append(bytes.Clone(b.data[b.next:]), b.data[:b.next]...)
+}
+
+// processOutput streams the output of a process line by line, prefixed with its name and masked.
+type processOutput struct {
+	p       *hostProcess
+	mask    func(string) string
+	partial []byte
+}
+
+func (o *processOutput) Write(b []byte) (int, error) {
+	o.p.mu.Lock()
+	o.p.output.Write(b)
+	o.p.mu.Unlock()
+
+	o.partial = append(o.partial, b...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(o.partial[:i]), "\r")
+		fmt.Printf("[%s] %s\n", o.p.name, o.mask(line))
+		o.partial = o.partial[i+1:]
+	}
+	return len(b), nil
+}
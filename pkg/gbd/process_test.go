@@ -0,0 +1,219 @@
+//go:build !windows
+
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"gopkg.in/yaml.v3"
+)
+
+func TestProcess(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("db:\n  host: db\n  port: 5432\n"), 0644))
+
+	var dep Dependency
+	require.NoError(t, yaml.Unmarshal([]byte(`
+kind: process
+name: api
+command: [sh, -c, 'cat {{ .Files }}/config.local.yaml; test "$GBD_FILES_DIR" = {{ .Files }} && echo "token: $API_TOKEN"; echo "listening on {{ .Values.port }}"; sleep 30']
+env:
+  API_TOKEN: s3cr3t-token
+replaceConfig:
+  - config_origin_path: /config.yaml
+    target_path: config.local.yaml
+    replacements:
+      - key: db.host
+        value:
+          fromContainer: db
+          propertyName: NetworkSettings.Networks[{NETWORK_ID}].Aliases[0]
+      - key: db.port
+        value: '{{ .Port "db" 5432 }}'
+        type: int
+waitFor:
+  strategy: log
+  waitForStrategy:
+    log: listening on
+    occurrence: 1
+    pollinterval: 10ms
+`), &dep))
+	require.True(t, dep.isProcess())
+
+	deps := []Dependency{{Name: "db", Alias: "pgtc", ExposePorts: []string{"5432"}}, dep}
+	s := &Stack{workDir: dir, components: []StackComponent{{Name: "db", MappedPorts: map[string]string{"5432": "49153"}}}}
+	s.data = templateData{Values: map[string]any{"port": 8080}, deps: deps, stack: s}
+	s.addSecret("s3cr3t-token")
+	data := s.data
+	data.host = true
+
+	cmp, err := s.startProcess(context.Background(), dep, map[string]string{"API_TOKEN": "s3cr3t-token"}, data)
+	require.NoError(t, err)
+	s.addComponent(cmp)
+	require.Equal(t, KindProcess, cmp.Kind)
+	require.NotZero(t, cmp.Pid)
+
+	// rendered configs are kept out of the working dir
+	_, err = os.Stat(filepath.Join(dir, "config.local.yaml"))
+	require.True(t, os.IsNotExist(err))
+	local := filepath.Join(cmp.process.filesDir, "config.local.yaml")
+	rendered, err := os.ReadFile(local)
+	require.NoError(t, err)
+	require.Equal(t, "db:\n  host: localhost\n  port: 49153\n", string(rendered))
+	info, err := os.Stat(local)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	token, err := s.resolveDerivedValue("token", &ContainerDerivedValue{FromLogs: "api", Regex: `token: (\S+)`})
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t-token", token)
+	_, err = s.resolveDerivedValue("ip", &ContainerDerivedValue{FromContainer: "api", ContainerPropertyPath: "NetworkSettings.IPAddress"})
+	require.Error(t, err)
+
+	state, err := cmp.process.State(context.Background())
+	require.NoError(t, err)
+	require.True(t, state.Running)
+
+	start := time.Now()
+	require.NoError(t, s.stopProcesses())
+	require.Less(t, time.Since(start), processStopTimeout)
+	require.True(t, cmp.process.exited())
+	_, err = os.Stat(cmp.process.filesDir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestProcessErrors(t *testing.T) {
+	dir := t.TempDir()
+	s := &Stack{workDir: dir}
+
+	_, err := s.startProcess(context.Background(), Dependency{Kind: KindProcess, Command: []string{"true"}}, nil, s.data)
+	require.ErrorContains(t, err, "requires a name")
+	_, err = s.startProcess(context.Background(), Dependency{Kind: KindProcess, Name: "api"}, nil, s.data)
+	require.ErrorContains(t, err, "requires a command")
+
+	// the origin of a config is never overwritten
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("a: 1\n"), 0644))
+	_, err = s.startProcess(context.Background(), Dependency{
+		Kind:          KindProcess,
+		Name:          "api",
+		Command:       []string{"true"},
+		ReplaceConfig: []ConfigReplacement{{ConfigOriginPath: "/config.yaml", TargetPath: filepath.Join(dir, "config.yaml")}},
+	}, nil, s.data)
+	require.ErrorContains(t, err, "must differ from its origin")
+
+	// processes which exit before they are ready fail the wait strategy
+	_, err = s.startProcess(context.Background(), Dependency{
+		Kind:    KindProcess,
+		Name:    "api",
+		Command: []string{"sh", "-c", "exit 3"},
+		WaitFor: WaitFor{WaitForStrategy: wait.ForLog("ready").WithStartupTimeout(5 * time.Second)},
+	}, nil, s.data)
+	require.Error(t, err)
+}
+
+func TestProcessKeepsHostFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := &Stack{workDir: dir}
+	existing := filepath.Join(dir, "app.yaml")
+	require.NoError(t, os.WriteFile(existing, []byte("checked: in\n"), 0644))
+
+	_, err := s.startProcess(context.Background(), Dependency{
+		Kind:    KindProcess,
+		Name:    "api",
+		Command: []string{"sleep", "30"},
+		Files:   []File{{TargetPath: existing, Content: []byte("rendered: true\n")}},
+	}, nil, s.data)
+	require.ErrorContains(t, err, "exists already")
+
+	created := filepath.Join(dir, "created.yaml")
+	cmp, err := s.startProcess(context.Background(), Dependency{
+		Kind:    KindProcess,
+		Name:    "api",
+		Command: []string{"sleep", "30"},
+		Files:   []File{{TargetPath: created, Content: []byte("rendered: true\n")}, {TargetPath: "local.yaml", Content: []byte("a: 1\n")}},
+	}, nil, s.data)
+	require.NoError(t, err)
+	s.addComponent(cmp)
+	require.FileExists(t, created)
+	require.FileExists(t, filepath.Join(cmp.process.filesDir, "local.yaml"))
+	require.NoError(t, s.stopProcesses())
+
+	b, err := os.ReadFile(existing)
+	require.NoError(t, err)
+	require.Equal(t, "checked: in\n", string(b))
+	require.NoFileExists(t, created)
+	require.NoDirExists(t, cmp.process.filesDir)
+}
+
+func TestProcessOutput(t *testing.T) {
+	b := tailBuffer{limit: 8}
+	for _, w := range []string{"abc", "defgh", "ij", "klmnopqrstu", "vw"} {
+		n, err := b.Write([]byte(w))
+		require.NoError(t, err)
+		require.Equal(t, len(w), n)
+	}
+	require.Equal(t, "pqrstuvw", string(b.Bytes()))
+	b = tailBuffer{limit: 8}
+	_, _ = b.Write([]byte("abcdefgh"))
+	require.Equal(t, "abcdefgh", string(b.Bytes()))
+	_, _ = b.Write([]byte("i"))
+	require.Equal(t, "bcdefghi", string(b.Bytes()))
+
+	p := &hostProcess{name: "api", done: make(chan struct{})}
+	_, _, err := p.Exec(context.Background(), []string{"true"})
+	require.EqualError(t, err, "exec is not supported for process 'api'")
+}
+
+func TestProcessWaitForPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port := nat.Port(fmt.Sprintf("%d/tcp", l.Addr().(*net.TCPAddr).Port))
+
+	p := &hostProcess{name: "api", ports: []string{string(port)}, done: make(chan struct{})}
+	require.NoError(t, p.waitForPort(context.Background(), wait.ForListeningPort(port)))
+	require.NoError(t, p.waitForPort(context.Background(), wait.ForExposedPort()))
+	require.NoError(t, l.Close())
+	err = p.waitForPort(context.Background(), wait.ForListeningPort(port).WithStartupTimeout(200*time.Millisecond))
+	require.ErrorContains(t, err, "is not ready after 200ms")
+
+	close(p.done)
+	err = p.waitForPort(context.Background(), wait.ForListeningPort(port))
+	require.ErrorContains(t, err, "process exited")
+}
+
+func TestTemplateAddresses(t *testing.T) {
+	deps := []Dependency{
+		{Name: "db", Alias: "pgtc", ExposePorts: []string{"5432"}},
+		{Name: "cache", ExposePorts: []string{"6379/tcp"}},
+		{Name: "api", Kind: KindProcess},
+	}
+	s := &Stack{components: []StackComponent{
+		{Name: "db", MappedPorts: map[string]string{"5432": "49153"}},
+		{Name: "cache", MappedPorts: map[string]string{"6379/tcp": "49154"}},
+	}}
+	data := templateData{deps: deps, stack: s}
+
+	out, err := renderTemplate("addr", `{{ .Address "db" 5432 }} {{ .Host "cache" }}:{{ .Port "cache" "6379" }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, "pgtc:5432 cache:6379", out)
+	_, err = renderTemplate("addr", `{{ .Host "api" }}`, data)
+	require.Error(t, err)
+
+	data.host = true
+	out, err = renderTemplate("addr", `{{ .Address "pgtc" 5432 }} {{ .Address "cache" 6379 }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, "localhost:49153 localhost:49154", out)
+	_, err = renderTemplate("addr", `{{ .Port "db" 8080 }}`, data)
+	require.ErrorContains(t, err, "not exposed")
+	_, err = renderTemplate("addr", `{{ .Host "missing" }}`, data)
+	require.ErrorContains(t, err, "not found")
+}
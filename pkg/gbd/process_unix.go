@@ -0,0 +1,22 @@
+//go:build !windows
+
+package gbd
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the process in its own group, so that the children it spawns (e.g. the binary
+// built by 'go run') are stopped with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func interruptProcess(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+}
+
+func killProcess(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
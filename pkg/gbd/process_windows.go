@@ -0,0 +1,16 @@
+//go:build windows
+
+package gbd
+
+import "os/exec"
+
+func setProcessGroup(*exec.Cmd) {}
+
+// interruptProcess kills the process, windows has no interrupt signal for other processes.
+func interruptProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,149 @@
+package gbd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/testcontainers/testcontainers-go"
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// UserConfigEnv is the environment variable holding the path of the user config, which defaults to
+// gbd/config.yaml in the user config dir (e.g. ~/.config/gbd/config.yaml).
+const UserConfigEnv = "GBD_CONFIG"
+
+// UserConfig is the configuration of gbd shared by all the stacks of a user.
+type UserConfig struct {
+	ImageRewrites []ImageRewrite `yaml:"imageRewrites,omitempty"`
+}
+
+// ImageRewrite rewrites the images of the dependencies before they are pulled, e.g. to pull through a mirror.
+// From matches the fully qualified image name (postgres is docker.io/library/postgres), a '*' in From matches
+// any text which replaces the '*' in To. It is written as {from, to} or as 'docker.io/* -> mirror.local:5000/*'.
+//
+// When BuildArg is set, images built by gbd get the registry of To (mirror.local:5000) as that build arg,
+// so that their Dockerfiles can pull the base images through the same mirror (FROM ${BuildArg}/library/golang).
+type ImageRewrite struct {
+	From     string `yaml:"from"`
+	To       string `yaml:"to"`
+	BuildArg string `yaml:"buildArg,omitempty"`
+}
+
+func (r *ImageRewrite) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		from, to, ok := strings.Cut(value.Value, "->")
+		if !ok {
+			return fmt.Errorf("image rewrite '%s': expected 'from -> to'", value.Value)
+		}
+		r.From, r.To = strings.TrimSpace(from), strings.TrimSpace(to)
+		return nil
+	}
+	type plain ImageRewrite
+	return value.Decode((*plain)(r))
+}
+
+// rewrite returns the rewritten image name and whether the rule matched.
+func (r ImageRewrite) rewrite(name string) (string, bool) {
+	pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(r.From), `\*`, "(.*)") + "$"
+	m := regexp.MustCompile(pattern).FindStringSubmatch(utils.NormalizeImageName(name))
+	if m == nil {
+		return name, false
+	}
+	out := r.To
+	for _, group := range m[1:] {
+		out = strings.Replace(out, "*", group, 1)
+	}
+	return out, true
+}
+
+// registry returns the registry part of To.
+func (r ImageRewrite) registry() string {
+	prefix, _, _ := strings.Cut(r.To, "*")
+	registry, _, _ := strings.Cut(prefix, "/")
+	return registry
+}
+
+// LoadUserConfig reads the user config, a missing file is an empty config.
+func LoadUserConfig() (*UserConfig, error) {
+	path := os.Getenv(UserConfigEnv)
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return &UserConfig{}, nil
+		}
+		path = filepath.Join(dir, "gbd", "config.yaml")
+	}
+	var cfg UserConfig
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// imageRewrites returns the rewrite rules of the stack followed by the ones of the user config, the first
+// matching rule applies.
+func (e *Env) imageRewrites() ([]ImageRewrite, error) {
+	cfg, err := LoadUserConfig()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]ImageRewrite{}, e.ImageRewrites...), cfg.ImageRewrites...), nil
+}
+
+// rewriteImage applies the first matching rule to an image repository, unmatched images are kept as they are.
+func rewriteImage(rules []ImageRewrite, name string) string {
+	for _, r := range rules {
+		if out, ok := r.rewrite(name); ok {
+			return out
+		}
+	}
+	return name
+}
+
+// rewriteBuildArgs adds the registry build args of the rules to the build args of a dependency,
+// build args set by the dependency take precedence.
+func rewriteBuildArgs(rules []ImageRewrite, args map[string]*string) map[string]*string {
+	out := make(map[string]*string, len(args))
+	for _, r := range rules {
+		if r.BuildArg != "" {
+			if _, ok := out[r.BuildArg]; !ok {
+				registry := r.registry()
+				out[r.BuildArg] = &registry
+			}
+		}
+	}
+	for k, v := range args {
+		out[k] = v
+	}
+	return out
+}
+
+// registryAuth returns the base64 encoded auth of the registry of an image from the docker config.json,
+// empty for anonymous pulls.
+func registryAuth(ctx context.Context, image string) string {
+	_, auth, err := testcontainers.DockerImageAuth(ctx, image)
+	if err != nil {
+		return ""
+	}
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(b)
+}
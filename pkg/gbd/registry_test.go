@@ -0,0 +1,55 @@
+package gbd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+func TestImageRewrites(t *testing.T) {
+	require.Equal(t, "docker.io/library/postgres", utils.NormalizeImageName("postgres"))
+	require.Equal(t, "docker.io/bitnami/kafka", utils.NormalizeImageName("bitnami/kafka"))
+	require.Equal(t, "ghcr.io/org/app", utils.NormalizeImageName("ghcr.io/org/app"))
+	require.Equal(t, "localhost/app", utils.NormalizeImageName("localhost/app"))
+
+	userCfg := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(userCfg, []byte(`
+imageRewrites:
+  - "docker.io/* -> mirror.local:5000/*"
+`), 0644))
+	t.Setenv(UserConfigEnv, userCfg)
+
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+imageRewrites:
+  - from: docker.io/library/redis
+    to: cache.local/redis
+  - from: ghcr.io/*
+    to: mirror.local:5000/ghcr/*
+    buildArg: REGISTRY
+`), &e))
+	rules, err := e.imageRewrites()
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+
+	require.Equal(t, "cache.local/redis", rewriteImage(rules, "redis"))
+	require.Equal(t, "mirror.local:5000/library/postgres", rewriteImage(rules, "postgres"))
+	require.Equal(t, "mirror.local:5000/bitnami/kafka", rewriteImage(rules, "bitnami/kafka"))
+	require.Equal(t, "mirror.local:5000/ghcr/org/app", rewriteImage(rules, "ghcr.io/org/app"))
+	require.Equal(t, "quay.io/org/app", rewriteImage(rules, "quay.io/org/app"))
+
+	own := "docker.io"
+	args := rewriteBuildArgs(rules, map[string]*string{"VERSION": nil})
+	require.Equal(t, "mirror.local:5000", *args["REGISTRY"])
+	require.Contains(t, args, "VERSION")
+	args = rewriteBuildArgs(rules, map[string]*string{"REGISTRY": &own})
+	require.Equal(t, "docker.io", *args["REGISTRY"])
+
+	var bad ImageRewrite
+	require.Error(t, yaml.Unmarshal([]byte(`"docker.io/*"`), &bad))
+}
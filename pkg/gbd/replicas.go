@@ -0,0 +1,82 @@
+package gbd
+
+import (
+	"fmt"
+	"slices"
+)
+
+// replicaOf is the logical dependency of a replica: its name and alias, shared by all replicas, and the index
+// of the replica.
+type replicaOf struct {
+	name  string
+	alias string
+	index int
+}
+
+// replicaName returns the name of the replica index of a dependency, also used for its alias.
+func replicaName(name string, index int) string {
+	return fmt.Sprintf("%s-%d", name, index)
+}
+
+// expandReplicas returns the dependencies with the replicated ones replaced by their replicas. A replica is named
+// and aliased <name>-<index>, it joins its networks with the name and alias of the dependency as well, so that
+// they resolve to all replicas.
+func expandReplicas(deps []Dependency) ([]Dependency, error) {
+	var out []Dependency
+	for _, dep := range deps {
+		if dep.Replicas < 0 {
+			return nil, fmt.Errorf("%s: replicas must not be negative", dep.Name)
+		}
+		if dep.Replicas <= 1 {
+			out = append(out, dep)
+			continue
+		}
+		if dep.Name == "" {
+			return nil, fmt.Errorf("%s: replicas require a name", dep.Image)
+		}
+		if dep.isProcess() || dep.isExternal() {
+			return nil, fmt.Errorf("%s: replicas are only supported for containers", dep.Name)
+		}
+		for i := 0; i < dep.Replicas; i++ {
+			r := dep
+			r.Name = replicaName(dep.Name, i)
+			if dep.Alias != "" {
+				r.Alias = replicaName(dep.Alias, i)
+			}
+			// every replica renders its own configs
+			r.ReplaceConfig = slices.Clone(dep.ReplaceConfig)
+			r.replica = &replicaOf{name: dep.Name, alias: dep.Alias, index: i}
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// replicaIndex returns the index of a replica, 0 for a dependency without replicas.
+func (d Dependency) replicaIndex() int {
+	if d.replica == nil {
+		return 0
+	}
+	return d.replica.index
+}
+
+// group returns the logical name of a dependency, the one of its replicas included.
+func (d Dependency) group() string {
+	if d.replica == nil {
+		return d.Name
+	}
+	return d.replica.name
+}
+
+// GetComponents returns the components of a dependency by its name, all of its replicas when it has some.
+func (s *Stack) GetComponents(name string) []StackComponent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []StackComponent
+	for _, c := range s.components {
+		if c.Name == name || c.Group == name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package gbd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestReplicas(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+dependencies:
+  - image: bitnami/kafka
+    version: latest
+    name: kafka
+    alias: broker
+    replicas: 3
+    exposePorts: ["9092"]
+    env:
+      KAFKA_CFG_NODE_ID: "{{ .Index }}"
+  - image: api
+    version: latest
+    name: api
+    env:
+      BROKERS: '{{ .Address "kafka" 9092 }}'
+      LEADER: '{{ .Address "kafka-0" 9092 }}'
+`), &e))
+
+	deps, err := expandReplicas(e.Dependencies)
+	require.NoError(t, err)
+	require.Len(t, deps, 4)
+	require.Equal(t, "kafka-1", deps[1].Name)
+	require.Equal(t, "broker-1", deps[1].Alias)
+	require.Equal(t, 1, deps[1].replicaIndex())
+	require.Equal(t, "kafka", deps[1].group())
+	require.Equal(t, "api", deps[3].group())
+
+	configs, err := e.networkConfigs()
+	require.NoError(t, err)
+	attachments, err := dependencyNetworks(deps[1], configs)
+	require.NoError(t, err)
+	require.Equal(t, []networkAttachment{{name: defaultNetwork, aliases: []string{"broker-1", "broker", "kafka"}}}, attachments)
+
+	_, err = expandReplicas([]Dependency{{Image: "kafka", Replicas: 2}})
+	require.ErrorContains(t, err, "replicas require a name")
+	_, err = expandReplicas([]Dependency{{Name: "api", Kind: KindProcess, Replicas: 2}})
+	require.ErrorContains(t, err, "only supported for containers")
+
+	s := &Stack{components: []StackComponent{
+		{Name: "kafka-0", Group: "kafka", MappedPorts: map[string]string{"9092": "49100"}},
+		{Name: "kafka-1", Group: "kafka", Index: 1, MappedPorts: map[string]string{"9092": "49101"}},
+		{Name: "kafka-2", Group: "kafka", Index: 2, MappedPorts: map[string]string{"9092": "49102"}},
+	}}
+	require.Len(t, s.GetComponents("kafka"), 3)
+	require.Len(t, s.GetComponents("kafka-2"), 1)
+	cmp, err := s.GetComponent("kafka")
+	require.NoError(t, err)
+	require.Equal(t, "kafka-0", cmp.Name)
+
+	data := templateData{deps: e.Dependencies, stack: s, Index: 2}
+	out, err := renderTemplate("addr", `{{ .Index }} {{ .Host "kafka" }} {{ .Host "kafka-1" }} {{ .Host "broker-2" }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, "2 broker broker-1 broker-2", out)
+	data.host = true
+	out, err = renderTemplate("addr", `{{ .Address "kafka" 9092 }} {{ .Address "broker-1" 9092 }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, "localhost:49100 localhost:49101", out)
+
+	e.ContextDir = t.TempDir()
+	dir := t.TempDir()
+	_, err = e.ExportCompose(dir)
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	require.NoError(t, err)
+	var cf composeFile
+	require.NoError(t, yaml.Unmarshal(b, &cf))
+	require.Len(t, cf.Services, 4)
+	require.Equal(t, "1", cf.Services["kafka-1"].Environment["KAFKA_CFG_NODE_ID"])
+	require.Equal(t, []string{"broker-1", "broker", "kafka"}, cf.Services["kafka-1"].Networks[defaultNetwork].Aliases)
+	require.Equal(t, "broker:9092", cf.Services["api"].Environment["BROKERS"])
+	require.Equal(t, "broker-0:9092", cf.Services["api"].Environment["LEADER"])
+}
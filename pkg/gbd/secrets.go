@@ -0,0 +1,127 @@
+package gbd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// SecretsKeyEnv is the environment variable holding the base64 encoded key of the secrets file.
+const SecretsKeyEnv = "GBD_SECRETS_KEY"
+
+// SecretSource is a value that is not stored in the stack file: the content of File, a path on the host
+// (relative to the context dir), or the entry SecretRef of the encrypted secrets file of the Env.
+// Values read from a SecretSource are always masked and never written to disk by Build.
+type SecretSource struct {
+	File      string `yaml:"file,omitempty"`
+	SecretRef string `yaml:"secretRef,omitempty"`
+}
+
+func (s SecretSource) isSet() bool {
+	return s.File != "" || s.SecretRef != ""
+}
+
+// secret reads the value of a SecretSource, trailing newlines of files are removed.
+func (d templateData) secret(src SecretSource) (string, error) {
+	if src.SecretRef != "" {
+		v, ok := d.Secrets[src.SecretRef]
+		if !ok {
+			return "", fmt.Errorf("secret '%s' not found in the secrets file", src.SecretRef)
+		}
+		return v, nil
+	}
+	path := src.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(d.contextDir, path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// loadSecrets decrypts the secrets file of the Env in memory, the key is read from SecretsKeyEnv or SecretsKeyFile.
+func (e *Env) loadSecrets() (map[string]string, error) {
+	if e.SecretsFile == "" {
+		return nil, nil
+	}
+	key, err := SecretsKey(e.contextPath(e.SecretsKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	return ReadSecretsFile(e.contextPath(e.SecretsFile), key)
+}
+
+// contextPath resolves a path relative to the context dir.
+func (e *Env) contextPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(e.ContextDir, path)
+}
+
+// SecretsKey returns the key of the secrets file from SecretsKeyEnv, or from keyFile when the variable is not set.
+func SecretsKey(keyFile string) ([]byte, error) {
+	if v := os.Getenv(SecretsKeyEnv); v != "" {
+		return utils.ParseSecretsKey(v)
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("no secrets key, set %s or a key file", SecretsKeyEnv)
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return utils.ParseSecretsKey(string(b))
+}
+
+// GenerateSecretsKey returns a new base64 encoded key for a secrets file.
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, utils.SecretsKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ReadSecretsFile decrypts a secrets file, a missing file holds no secrets.
+func ReadSecretsFile(path string, key []byte) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := utils.DecryptSecrets(key, b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return secrets, nil
+}
+
+// WriteSecretsFile encrypts secrets to path, the plaintext only exists in memory.
+func WriteSecretsFile(path string, key []byte, secrets map[string]string) error {
+	plaintext, err := yaml.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	b, err := utils.EncryptSecrets(key, plaintext)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
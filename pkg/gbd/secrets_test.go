@@ -0,0 +1,122 @@
+package gbd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestSecretSources(t *testing.T) {
+	dir := t.TempDir()
+	encoded, err := GenerateSecretsKey()
+	require.NoError(t, err)
+	t.Setenv(SecretsKeyEnv, encoded)
+	key, err := SecretsKey("")
+	require.NoError(t, err)
+
+	require.NoError(t, WriteSecretsFile(filepath.Join(dir, "secrets.enc"), key, map[string]string{"api_key": "k3y-value"}))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "db_pass"), []byte("p4ss-value\n"), 0600))
+	b, err := os.ReadFile(filepath.Join(dir, "secrets.enc"))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "k3y-value")
+
+	var dep Dependency
+	require.NoError(t, yaml.Unmarshal([]byte(`
+env:
+  DB_PASS: {file: db_pass}
+  API: {secretRef: api_key}
+replaceConfig:
+  - config_origin_path: config.yaml
+    replacements:
+      - key: api.key
+        source: {secretRef: api_key}
+      - key: storage
+        value: {file: data.db}
+`), &dep))
+	require.Equal(t, "db_pass", dep.EnvVars["DB_PASS"].File)
+
+	e := &Env{ContextDir: dir, SecretsFile: "secrets.enc", Dependencies: []Dependency{dep}}
+	secrets, err := e.loadSecrets()
+	require.NoError(t, err)
+	data := templateData{Secrets: secrets, contextDir: dir}
+
+	env, err := renderEnv(dep.envVars(), data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"DB_PASS": "p4ss-value", "API": "k3y-value"}, env)
+
+	v, err := renderReplacement(dep.ReplaceConfig[0].Replacements[0], data)
+	require.NoError(t, err)
+	require.Equal(t, "k3y-value", v)
+
+	// a value shaped like a source is a plain map
+	v, err = renderReplacement(dep.ReplaceConfig[0].Replacements[1], data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"file": "data.db"}, v)
+
+	_, err = data.secret(SecretSource{SecretRef: "missing"})
+	require.Error(t, err)
+
+	// dumps keep the references
+	b, err = yaml.Marshal(e.masked())
+	require.NoError(t, err)
+	require.Contains(t, string(b), "file: db_pass")
+	require.Contains(t, string(b), "secretRef: api_key")
+
+	t.Setenv(SecretsKeyEnv, "")
+	_, err = e.loadSecrets()
+	require.Error(t, err)
+}
+
+func TestExportSecrets(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("api:\n  key: none\n  url: none\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "db_pass"), []byte("p4ss-value\n"), 0600))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+dependencies:
+  - image: api
+    version: latest
+    name: api
+    env:
+      DB_PASS: {file: db_pass}
+      MODE: test
+    replaceConfig:
+      - config_origin_path: /config.yaml
+        target_path: /etc/api/config.yaml
+        replacements:
+          - key: api.key
+            source: {file: db_pass}
+          - key: api.url
+            value: http://api
+`), &e))
+	e.ContextDir = dir
+	want := []string{
+		"api: env 'DB_PASS' is a secret and is not exported",
+		"api: 'api.key' in '/config.yaml' is a secret and is not exported",
+	}
+
+	out := t.TempDir()
+	unresolved, err := e.ExportCompose(out)
+	require.NoError(t, err)
+	require.Equal(t, want, unresolved)
+	b, err := os.ReadFile(filepath.Join(out, "docker-compose.yml"))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "DB_PASS:")
+	require.Contains(t, string(b), "MODE: test")
+	cfg, err := os.ReadFile(filepath.Join(out, "configs", "api", "config.yaml"))
+	require.NoError(t, err)
+	require.Contains(t, string(cfg), "key: none")
+	require.Contains(t, string(cfg), "url: http://api")
+
+	unresolved, err = e.ExportScript(out)
+	require.NoError(t, err)
+	require.Equal(t, want, unresolved)
+	b, err = os.ReadFile(filepath.Join(out, exportScriptFile))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "DB_PASS=")
+	require.NotContains(t, string(b), "p4ss-value")
+}
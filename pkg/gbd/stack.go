@@ -2,12 +2,12 @@ package gbd
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/testcontainers/testcontainers-go"
@@ -17,123 +17,186 @@ import (
 )
 
 type Stack struct {
+	// id namespaces the containers of the stack, see Env.StackID
+	id         string
 	components []StackComponent
-	network    *testcontainers.DockerNetwork
-	tempDir    string
-	workDir    string
+	// network is the default network, the first of networks
+	network  *testcontainers.DockerNetwork
+	networks map[string]*testcontainers.DockerNetwork
+	// joined are the external networks, which are not removed
+	joined  []string
+	workDir string
+	// derived caches the resolved derived values of the Build
+	derived map[string]any
+	data    templateData
+	// secrets are masked in everything gbd prints, unless noMask is set
+	secrets []string
+	noMask  bool
+
+	// mu guards the components updated by Supervise, which is stopped by Teardown
+	mu              sync.RWMutex
+	tornDown        bool
+	stopSupervising context.CancelFunc
 }
 
 func (s *Stack) addComponent(c StackComponent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.components = append(s.components, c)
 }
 
+// snapshot returns a copy of the components, which Supervise updates while the stack runs.
+func (s *Stack) snapshot() []StackComponent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.components)
+}
+
 func (s *Stack) Teardown(ctx context.Context) error {
-	ids := make([]string, len(s.components))
-	for i := range s.components {
-		ids[i] = s.components[i].ContainerId
+	s.mu.Lock()
+	s.tornDown = true
+	if s.stopSupervising != nil {
+		s.stopSupervising()
+	}
+	components := slices.Clone(s.components)
+	s.mu.Unlock()
+	// processes run against the containers, they are stopped first
+	if err := s.stopProcesses(); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(components))
+	// external containers have no container of the stack either
+	for i := range components {
+		if components[i].container == nil {
+			continue
+		}
+		ids = append(ids, components[i].ContainerId)
 		d := 5 * time.Second
-		err := s.components[i].container.Stop(ctx, &d)
+		err := components[i].container.Stop(ctx, &d)
 		if err != nil {
 			return err
 		}
 	}
 	utils.WaitForContainerToBeRemoved(ids...)
-	return s.network.Remove(ctx)
+	var errs []error
+	for _, name := range sortedKeys(s.networks) {
+		if slices.Contains(s.joined, name) {
+			continue
+		}
+		errs = append(errs, s.networks[name].Remove(ctx))
+	}
+	return errors.Join(errs...)
 }
 
+// stopProcesses stops the processes of the stack.
+func (s *Stack) stopProcesses() error {
+	var errs []error
+	for _, c := range s.snapshot() {
+		if c.process != nil {
+			errs = append(errs, c.process.stop())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetComponent returns a component by its name, the first replica of a dependency with replicas.
 func (s *Stack) GetComponent(name string) (StackComponent, error) {
+	s.mu.RLock()
 	for _, c := range s.components {
 		if c.Name == name {
+			s.mu.RUnlock()
 			return c, nil
 		}
 	}
+	s.mu.RUnlock()
+	if cs := s.GetComponents(name); len(cs) > 0 {
+		return cs[0], nil
+	}
 	return StackComponent{}, fmt.Errorf("component not found")
 
 }
 
+// CACertificate returns the PEM encoded CA certificate of the stack, nil when no dependency uses TLS.
+func (s *Stack) CACertificate() []byte {
+	if s.data.CA == "" {
+		return nil
+	}
+	return []byte(s.data.CA)
+}
+
+// Print returns the components of the stack as yaml, masked.
 func (s *Stack) Print() []byte {
-	b, err := yaml.Marshal(s)
+	b, err := yaml.Marshal(s.snapshot())
 	if err != nil {
 		log.Println(err)
 	}
-	return b
+	return []byte(s.mask(string(b)))
 }
 
-func (s *Stack) replaceConfigs(replacements []ConfigReplacement) error {
+// addSecrets registers generated values to be masked.
+func (s *Stack) addSecrets(values map[string]any) {
+	for _, v := range values {
+		switch tv := v.(type) {
+		case KeyPair:
+			s.secrets = append(s.secrets, tv.PrivateKey)
+		case string:
+			s.secrets = append(s.secrets, tv)
+		}
+	}
+}
+
+// mask replaces the secrets of the stack in str.
+func (s *Stack) mask(str string) string {
+	if s.noMask {
+		return str
+	}
+	for _, secret := range s.secrets {
+		if secret != "" {
+			str = strings.ReplaceAll(str, secret, maskedValue)
+		}
+	}
+	return str
+}
+
+// replaceConfigs renders the replaceConfig files of a dependency in memory with its data, image is used for
+// the ones extracted from the image. For a process on the host (data.host) the network addresses of containers
+// resolve to localhost.
+func (s *Stack) replaceConfigs(ctx context.Context, replacements []ConfigReplacement, image string, data templateData) error {
+	host := data.host
 	for i, r := range replacements {
-		cfg, err := parseConfig(s.workDir + r.ConfigOriginPath)
+		cfg, err := loadConfig(ctx, r, s.workDir, image)
 		if err != nil {
 			return err
 		}
 		for _, rep := range r.Replacements {
-			if dv, ok := rep.Value.(*ContainerDerivedValue); ok {
-				s.replaceConfigDerivedValue(rep.Key, dv, cfg)
-			} else if dv, ok := rep.Value.(map[string]any); !ok {
-				s.replaceConfigString(rep.Key, rep.Value, cfg)
-			} else {
-				s.replaceConfigDerivedValue(rep.Key, &ContainerDerivedValue{
-					FromContainer:         dv["fromContainer"].(string),
-					ContainerPropertyPath: dv["propertyName"].(string),
-				}, cfg)
+			value, err := renderReplacement(rep, data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", r.ConfigOriginPath, err)
 			}
-		}
-		fn := filepath.Join(s.tempDir, utils.ExtractFileName(r.ConfigOriginPath))
-		if err := s.flushConfig(fn, cfg); err != nil {
-			return err
-		}
-		replacements[i].hostFile = fn
-	}
-	return nil
-}
-
-func (s *Stack) replaceConfigDerivedValue(key string, value *ContainerDerivedValue, cfg map[string]any) {
-	var cvalue any
-	for _, c := range s.components {
-		if c.Name == value.FromContainer {
-
-			path := value.ContainerPropertyPath
-			if strings.Contains(path, networkReplaceId) {
-				path = strings.Replace(path, networkReplaceId, fmt.Sprintf("\"%s\"", c.Networks[0]), 1)
+			dv, derived := derivedValue(rep.Value)
+			if derived && host && dv.networkAddress() {
+				value = "localhost"
+			} else if derived {
+				value, err = s.resolveDerivedValue(rep.Key, dv)
+				if err != nil {
+					return err
+				}
 			}
-
-			containerCfg, err := utils.InspectContainer(context.Background(), c.Image, c.Version)
-			if err != nil {
-				panic(err)
+			if rep.Source != nil || rep.Secret || isSecretKey(rep.Key) {
+				s.addSecret(value)
 			}
-
-			cvalue, err = utils.FindValueInJson(containerCfg, path)
-			if err != nil {
-				panic(err)
+			if derived {
+				fmt.Printf("Replacing config '%s' with value '%s' from %s\n", rep.Key, s.mask(fmt.Sprint(value)), dv)
+			}
+			if err := replaceConfigValue(rep, value, cfg); err != nil {
+				return fmt.Errorf("%s: %w", r.ConfigOriginPath, err)
 			}
-
-			fmt.Printf("Replacing config '%s' from container '%s' with value '%v' mapped from '%s'\n", key, c.Name, cvalue, path)
 		}
-	}
-	keyPath := strings.Split(key, ".")
-	utils.FindAndReplace(keyPath, cvalue, cfg)
-}
-
-func (s *Stack) replaceConfigString(key string, value any, cfgMap map[string]any) {
-	keyPath := strings.Split(key, ".")
-	utils.FindAndReplace(keyPath, value, cfgMap)
-}
-
-func (s *Stack) flushConfig(target string, cfg map[string]any) error {
-	var bytes []byte
-	var err error
-	switch filepath.Ext(target) {
-	case ".yaml", ".yml":
-		bytes, err = yaml.Marshal(cfg)
-	case ".json":
-		bytes, err = json.Marshal(cfg)
-	case ".toml":
-		//bytes, err = toml.Marshal(cfg)
-	}
-	if err != nil {
-		return err
-	}
-	if err := os.WriteFile(target, bytes, 0644); err != nil {
-		return err
+		b, err := cfg.Bytes()
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.ConfigOriginPath, err)
+		}
+		replacements[i].rendered = b
 	}
 	return nil
 }
@@ -0,0 +1,350 @@
+package gbd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// Restart policies of a dependency, see Dependency.Restart.
+const (
+	RestartNo        string = "no"
+	RestartOnFailure string = "on-failure"
+	RestartAlways    string = "always"
+)
+
+// Actions of a SupervisorEvent.
+const (
+	ActionDie     string = "die"
+	ActionRestart string = "restart"
+)
+
+// crashLogLines is the number of log lines reported with a crash.
+const crashLogLines = 20
+
+// SupervisorEvent is a crash or a restart of a container of the stack, see Stack.Supervise.
+// Logs are the last lines of a crashed container, masked. A restart which changed the address or the mapped ports
+// of the container has IPChanged or PortsChanged set, Dependents are then the dependencies with values derived
+// from it or with templates of processes referring to it, which must be rebuilt.
+type SupervisorEvent struct {
+	Component    string
+	Action       string
+	ExitCode     int
+	OOMKilled    bool
+	Logs         []string
+	Restarts     int
+	IPChanged    bool
+	PortsChanged bool
+	Dependents   []string
+}
+
+func (e SupervisorEvent) String() string {
+	if e.Action == ActionRestart {
+		msg := fmt.Sprintf("Container '%s' restarted (%d restarts)", e.Component, e.Restarts)
+		switch {
+		case e.IPChanged && e.PortsChanged:
+			msg += ", its address and ports changed"
+		case e.IPChanged:
+			msg += ", its address changed"
+		case e.PortsChanged:
+			msg += ", its ports changed"
+		}
+		return msg
+	}
+	msg := fmt.Sprintf("Container '%s' exited with code %d", e.Component, e.ExitCode)
+	if e.OOMKilled {
+		msg += " (out of memory)"
+	}
+	return msg
+}
+
+// restartPolicy returns the docker restart policy of a dependency: no (default), always, or on-failure with
+// an optional maximum of retries, on-failure:3.
+func (d Dependency) restartPolicy() (container.RestartPolicy, error) {
+	name, max, found := strings.Cut(d.Restart, ":")
+	switch name {
+	case "", RestartNo, RestartAlways:
+		if found {
+			return container.RestartPolicy{}, fmt.Errorf("restart: only %s takes a maximum of retries", RestartOnFailure)
+		}
+		if name == "" {
+			name = RestartNo
+		}
+		return container.RestartPolicy{Name: name}, nil
+	case RestartOnFailure:
+		policy := container.RestartPolicy{Name: name}
+		if found {
+			n, err := strconv.Atoi(max)
+			if err != nil || n < 0 {
+				return container.RestartPolicy{}, fmt.Errorf("restart: invalid maximum of retries '%s'", max)
+			}
+			policy.MaximumRetryCount = n
+		}
+		return policy, nil
+	}
+	return container.RestartPolicy{}, fmt.Errorf("restart: unknown policy '%s'", d.Restart)
+}
+
+// Supervise reports the crashes and restarts of the containers of the stack to handler until ctx is done or the
+// stack is torn down. Containers are restarted by docker following their restart policy, a restarted component
+// is updated and the derived values are resolved again by later lookups. Processes report their exit themselves.
+func (s *Stack) Supervise(ctx context.Context, handler func(SupervisorEvent)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	if s.tornDown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopSupervising = cancel
+	s.mu.Unlock()
+
+	msgs, errs, err := utils.ContainerEvents(ctx, s.labels(""), "oom", "die", "start")
+	if err != nil {
+		return err
+	}
+	return s.superviseEvents(ctx, msgs, errs, handler)
+}
+
+// superviseEvents reports the container events of the stack to handler until ctx is done or the event stream fails.
+// A restarted container which cannot be inspected is reported and supervision goes on.
+func (s *Stack) superviseEvents(ctx context.Context, msgs <-chan events.Message, errs <-chan error, handler func(SupervisorEvent)) error {
+	oom := make(map[string]bool)
+	died := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case m := <-msgs:
+			id := m.Actor.ID
+			cmp, ok := s.componentByID(id)
+			if !ok {
+				continue
+			}
+			switch m.Action {
+			case "oom":
+				oom[id] = true
+			case "die":
+				code, _ := strconv.Atoi(m.Actor.Attributes["exitCode"])
+				ev := SupervisorEvent{Component: cmp.Name, Action: ActionDie, ExitCode: code, OOMKilled: oom[id]}
+				ev.Logs = s.crashLogs(ctx, id)
+				delete(oom, id)
+				died[id] = true
+				if s.isTornDown() {
+					return nil
+				}
+				handler(ev)
+			case "start":
+				if !died[id] {
+					continue
+				}
+				delete(died, id)
+				ev, err := s.restarted(ctx, id)
+				if err != nil {
+					fmt.Printf("Could not update the restarted container '%s': %s\n", cmp.Name, err)
+					continue
+				}
+				handler(ev)
+			}
+		}
+	}
+}
+
+// crashLogs returns the last log lines of a container, masked.
+func (s *Stack) crashLogs(ctx context.Context, id string) []string {
+	logs, err := utils.ContainerLogs(ctx, id)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(logs), "\n"), "\n")
+	if len(lines) > crashLogLines {
+		lines = lines[len(lines)-crashLogLines:]
+	}
+	for i := range lines {
+		lines[i] = s.mask(lines[i])
+	}
+	return lines
+}
+
+// restarted updates the component of a restarted container with its new address and mapped ports.
+func (s *Stack) restarted(ctx context.Context, id string) (SupervisorEvent, error) {
+	raw, err := utils.InspectContainerID(ctx, id)
+	if err != nil {
+		return SupervisorEvent{}, err
+	}
+	var info types.ContainerJSON
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return SupervisorEvent{}, err
+	}
+	return s.updateRestarted(id, info)
+}
+
+// updateRestarted updates the component of a restarted container from its inspect info.
+func (s *Stack) updateRestarted(id string, info types.ContainerJSON) (SupervisorEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.components {
+		c := &s.components[i]
+		if c.ContainerId != id {
+			continue
+		}
+		ev := SupervisorEvent{Component: c.Name, Action: ActionRestart}
+		if info.ContainerJSONBase != nil {
+			ev.Restarts = info.RestartCount
+		}
+		if info.NetworkSettings == nil {
+			return ev, nil
+		}
+		if len(c.Networks) > 0 {
+			if nw, ok := info.NetworkSettings.Networks[c.Networks[0]]; ok && nw.IPAddress != c.InternalIP {
+				c.InternalIP = nw.IPAddress
+				ev.IPChanged = true
+			}
+		}
+		// the components returned by GetComponent share the map, it is replaced
+		mapped := make(map[string]string, len(c.MappedPorts))
+		for port, host := range c.MappedPorts {
+			p := nat.Port(port)
+			if !strings.Contains(port, "/") {
+				p = nat.Port(port + "/tcp")
+			}
+			mapped[port] = host
+			if bindings := info.NetworkSettings.Ports[p]; len(bindings) > 0 && bindings[0].HostPort != host {
+				mapped[port] = bindings[0].HostPort
+				ev.PortsChanged = true
+			}
+		}
+		c.MappedPorts = mapped
+		if ev.IPChanged || ev.PortsChanged {
+			s.derived = nil
+			ev.Dependents = s.dependents(s.componentNames(*c)...)
+		}
+		return ev, nil
+	}
+	return SupervisorEvent{}, fmt.Errorf("container '%s' is not part of the stack", id)
+}
+
+// componentNames returns the names a component is referred to by: its name, its group and their aliases.
+func (s *Stack) componentNames(c StackComponent) []string {
+	names := []string{c.Name}
+	if c.Group != "" {
+		names = append(names, c.Group)
+	}
+	if dep, index, ok := s.data.dependency(c.Name); ok && dep.Alias != "" {
+		names = append(names, dep.Alias)
+		if index >= 0 {
+			names = append(names, replicaName(dep.Alias, index))
+		}
+	}
+	return names
+}
+
+// dependents returns the dependencies with values derived from a component, and the processes with templates
+// referring to it ({{ .Port "db" 5432 }} renders its mapped port on the host), by one of its names.
+func (s *Stack) dependents(names ...string) []string {
+	refers := func(text string) bool { return referencesComponent(text, names) }
+	var out []string
+	for _, dep := range s.data.deps {
+		if dep.derivesFrom(names) || (dep.isProcess() && slices.ContainsFunc(dep.templates(), refers)) {
+			out = append(out, dep.Name)
+		}
+	}
+	return out
+}
+
+// derivesFrom reports whether a replacement of the dependency is derived from one of the named components.
+func (d Dependency) derivesFrom(names []string) bool {
+	for _, r := range d.ReplaceConfig {
+		for _, rep := range r.Replacements {
+			dv, ok := derivedValue(rep.Value)
+			if ok && dv.component() != "" && slices.Contains(names, dv.component()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// templates returns the strings of a dependency which are rendered as templates: its env, command, replacement
+// values and templated files.
+func (d Dependency) templates() []string {
+	var out []string
+	for _, v := range d.envVars() {
+		out = append(out, v.Value)
+	}
+	out = append(out, d.Command...)
+	for _, r := range d.ReplaceConfig {
+		for _, rep := range r.Replacements {
+			out = appendStrings(out, rep.Value)
+		}
+	}
+	for _, f := range d.Files {
+		if f.Template {
+			out = append(out, string(f.Content))
+		}
+	}
+	return out
+}
+
+// appendStrings appends the strings of a replacement value, including the ones nested in maps and lists.
+func appendStrings(out []string, v any) []string {
+	switch tv := v.(type) {
+	case string:
+		out = append(out, tv)
+	case map[string]any:
+		for _, e := range tv {
+			out = appendStrings(out, e)
+		}
+	case []any:
+		for _, e := range tv {
+			out = appendStrings(out, e)
+		}
+	}
+	return out
+}
+
+// referencesComponent reports whether a template passes one of names to a function, as in {{ .Address "db" 5432 }}.
+func referencesComponent(text string, names []string) bool {
+	if !strings.Contains(text, "{{") {
+		return false
+	}
+	for _, name := range names {
+		if strings.Contains(text, strconv.Quote(name)) || strings.Contains(text, "`"+name+"`") {
+			return true
+		}
+	}
+	return false
+}
+
+// componentByID returns the component of a container of the stack.
+func (s *Stack) componentByID(id string) (StackComponent, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.components {
+		if c.ContainerId == id && c.container != nil {
+			return c, true
+		}
+	}
+	return StackComponent{}, false
+}
+
+func (s *Stack) isTornDown() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tornDown
+}
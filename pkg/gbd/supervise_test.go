@@ -0,0 +1,191 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	for restart, want := range map[string]container.RestartPolicy{
+		"":             {Name: RestartNo},
+		"no":           {Name: RestartNo},
+		"always":       {Name: RestartAlways},
+		"on-failure":   {Name: RestartOnFailure},
+		"on-failure:3": {Name: RestartOnFailure, MaximumRetryCount: 3},
+	} {
+		policy, err := Dependency{Restart: restart}.restartPolicy()
+		require.NoError(t, err, restart)
+		require.Equal(t, want, policy, restart)
+	}
+	for _, restart := range []string{"sometimes", "always:3", "on-failure:x", "on-failure:-1"} {
+		_, err := Dependency{Restart: restart}.restartPolicy()
+		require.Error(t, err, restart)
+	}
+
+	_, err := (&Stack{}).startProcess(context.Background(), Dependency{Kind: KindProcess, Name: "api", Command: []string{"true"}, Restart: "always"}, nil, templateData{})
+	require.ErrorContains(t, err, "restart is not supported")
+}
+
+func TestSupervise(t *testing.T) {
+	require.Equal(t, "Container 'api' exited with code 137 (out of memory)",
+		SupervisorEvent{Component: "api", Action: ActionDie, ExitCode: 137, OOMKilled: true}.String())
+	require.Equal(t, "Container 'db' restarted (2 restarts), its address changed",
+		SupervisorEvent{Component: "db", Action: ActionRestart, Restarts: 2, IPChanged: true}.String())
+
+	deps := []Dependency{
+		{Name: "db"},
+		{Name: "api", ReplaceConfig: []ConfigReplacement{{Replacements: []Replacement{
+			{Key: "db.ip", Value: &ContainerDerivedValue{FromContainer: "db", ContainerPropertyPath: "NetworkSettings.IPAddress"}},
+		}}}},
+		{Name: "worker", ReplaceConfig: []ConfigReplacement{{Replacements: []Replacement{{Key: "db.host", Value: "db"}}}}},
+		// processes render the mapped ports of the containers, containers their aliases and container ports
+		{Name: "web", Kind: KindProcess, Env: map[string]string{"DB_URL": `postgres://{{ .Address "db" 5432 }}/app`}},
+		{Name: "cli", Kind: KindProcess, Command: []string{"cli", "--port", `{{ .Port "pg" 5432 }}`}},
+		{Name: "tool", Env: map[string]string{"DB_HOST": `{{ .Host "db" }}`}},
+	}
+	s := &Stack{data: templateData{deps: deps}}
+	require.Equal(t, []string{"api", "web"}, s.dependents("db", ""))
+	require.Equal(t, []string{"cli"}, s.dependents("pg"))
+	require.Empty(t, s.dependents("worker", ""))
+
+	// a torn down stack is not supervised
+	require.NoError(t, s.Teardown(context.Background()))
+	require.NoError(t, s.Supervise(context.Background(), func(SupervisorEvent) { t.Fail() }))
+}
+
+func TestSuperviseEvents(t *testing.T) {
+	s := &Stack{components: []StackComponent{{Name: "db", ContainerId: "c1", container: logsContainer{}}}}
+	msgs, errs := make(chan events.Message), make(chan error)
+	got := make(chan SupervisorEvent)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.superviseEvents(ctx, msgs, errs, func(ev SupervisorEvent) { got <- ev }) }()
+
+	event := func(action, code string) events.Message {
+		return events.Message{Action: action, Actor: events.Actor{ID: "c1", Attributes: map[string]string{"exitCode": code}}}
+	}
+	send := func(m events.Message) {
+		select {
+		case msgs <- m:
+		case err := <-done:
+			t.Fatalf("supervision stopped: %v", err)
+		}
+	}
+	send(event("die", "1"))
+	require.Equal(t, ActionDie, (<-got).Action)
+	// the restarted container is gone before it is inspected, supervision goes on
+	send(event("start", ""))
+	send(events.Message{Action: "die", Actor: events.Actor{ID: "unknown"}})
+	send(event("die", "2"))
+	require.Equal(t, 2, (<-got).ExitCode)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestSuperviseRestarted(t *testing.T) {
+	deps := []Dependency{
+		{Name: "db", Alias: "pg"},
+		{Name: "web", Kind: KindProcess, Env: map[string]string{"DB_URL": `postgres://{{ .Address "pg" 5432 }}/app`}},
+	}
+	s := &Stack{components: []StackComponent{{
+		Name: "db", ContainerId: "c1", container: logsContainer{logs: "version 16.1\n"}, Networks: []string{"gbd"}, InternalIP: "10.0.0.2",
+		MappedPorts: map[string]string{"5432": "49153"},
+	}}}
+	s.data = templateData{deps: deps, stack: s, host: true}
+	restart := func(ip, port string) types.ContainerJSON {
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{RestartCount: 1},
+			NetworkSettings: &types.NetworkSettings{
+				NetworkSettingsBase: types.NetworkSettingsBase{Ports: nat.PortMap{"5432/tcp": {{HostPort: port}}}},
+				Networks:            map[string]*network.EndpointSettings{"gbd": {IPAddress: ip}},
+			},
+		}
+	}
+
+	// a restart with the same address and ports has no dependents
+	ev, err := s.updateRestarted("c1", restart("10.0.0.2", "49153"))
+	require.NoError(t, err)
+	require.Equal(t, SupervisorEvent{Component: "db", Action: ActionRestart, Restarts: 1}, ev)
+
+	// a new mapped port is rendered again by the processes
+	ev, err = s.updateRestarted("c1", restart("10.0.0.2", "49200"))
+	require.NoError(t, err)
+	require.True(t, ev.PortsChanged)
+	require.False(t, ev.IPChanged)
+	require.Equal(t, []string{"web"}, ev.Dependents)
+	port, err := s.data.Port("db", 5432)
+	require.NoError(t, err)
+	require.Equal(t, "49200", port)
+
+	_, err = s.updateRestarted("c2", restart("10.0.0.2", "49200"))
+	require.ErrorContains(t, err, "not part of the stack")
+
+	// restarts update the components while they are read, see go test -race
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, err := s.updateRestarted("c1", restart(fmt.Sprintf("10.0.0.%d", i%2+2), fmt.Sprint(49000+i)))
+			require.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			require.NotEmpty(t, s.Print())
+			_, err := s.data.Port("db", 5432)
+			require.NoError(t, err)
+			_, err = s.GetComponent("db")
+			require.NoError(t, err)
+			_, err = s.resolveDerivedValue("db.version", &ContainerDerivedValue{FromLogs: "db", Regex: `version (\S+)`})
+			require.NoError(t, err)
+		}
+	}()
+	wg.Wait()
+	require.NoError(t, s.Teardown(context.Background()))
+}
+
+func TestExportRestart(t *testing.T) {
+	t.Setenv(UserConfigEnv, filepath.Join(t.TempDir(), "config.yaml"))
+	var e Env
+	require.NoError(t, yaml.Unmarshal([]byte(`
+dependencies:
+  - image: api
+    version: latest
+    name: api
+    restart: on-failure:3
+`), &e))
+	e.ContextDir = t.TempDir()
+	dir := t.TempDir()
+	_, err := e.ExportCompose(dir)
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	require.NoError(t, err)
+	var cf composeFile
+	require.NoError(t, yaml.Unmarshal(b, &cf))
+	require.Equal(t, "on-failure:3", cf.Services["api"].Restart)
+
+	_, err = e.ExportScript(dir)
+	require.NoError(t, err)
+	b, err = os.ReadFile(filepath.Join(dir, exportScriptFile))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "--restart 'on-failure:3'")
+
+	e.Dependencies[0].Restart = "sometimes"
+	_, err = e.ExportCompose(dir)
+	require.ErrorContains(t, err, "unknown policy")
+}
@@ -0,0 +1,276 @@
+package gbd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+// templateData is what templates in env values, replacement values and templated files are rendered with.
+// TLS holds the issued certificates by dependency name (or alias) and CA the PEM of the stack CA.
+// Secrets are the entries of the secrets file, contextDir resolves the files of a SecretSource.
+// Env is the environment of the host and Git the revision checked out in the context dir, Index is the index of
+// the replica being rendered. Files is the dir of the rendered configs and files of a process, empty for containers.
+// Host, Port and Address resolve the address of a dependency from the point of view of the one being rendered,
+// host is set for processes which reach the containers through their mapped ports, containers reach processes
+// through host.docker.internal with hostAccess or else through the gateway of the stack network.
+type templateData struct {
+	Values     map[string]any
+	TLS        map[string]Certificate
+	CA         string
+	Secrets    map[string]string
+	Env        map[string]string
+	Git        GitInfo
+	Index      int
+	Files      string
+	contextDir string
+	deps       []Dependency
+	stack      *Stack
+	host       bool
+	hostAccess bool
+}
+
+// Host returns the host name of a dependency (by name or alias): its alias on the stack network, or localhost
+// when rendered for a process. External dependencies without an alias are reached by their container name.
+// A dependency with replicas resolves to all of them, a single replica is named <name>-<index>.
+func (d templateData) Host(name string) (string, error) {
+	dep, index, ok := d.dependency(name)
+	if !ok {
+		return "", fmt.Errorf("dependency '%s' not found", name)
+	}
+	if dep.isProcess() && !d.host {
+		if d.hostAccess {
+			return hostGatewayName, nil
+		}
+		if d.stack == nil {
+			return "", fmt.Errorf("dependency '%s' runs on the host, which requires hostAccess", name)
+		}
+		return d.stack.hostAddress(context.Background())
+	}
+	if d.host {
+		return "localhost", nil
+	}
+	if index >= 0 && dep.Alias != "" {
+		return replicaName(dep.Alias, index), nil
+	}
+	if index >= 0 {
+		return replicaName(dep.Name, index), nil
+	}
+	if dep.Alias != "" {
+		return dep.Alias, nil
+	}
+	if dep.isExternal() && d.stack != nil {
+		if c, err := d.stack.GetComponent(dep.Name); err == nil {
+			return c.ContainerName, nil
+		}
+	}
+	return dep.Name, nil
+}
+
+// Port returns the port of a dependency: port itself, or its mapped port on the host when rendered for a process.
+// The dependency must be started before the one being rendered.
+func (d templateData) Port(name string, port any) (string, error) {
+	p := fmt.Sprint(port)
+	dep, index, ok := d.dependency(name)
+	if !ok {
+		return "", fmt.Errorf("dependency '%s' not found", name)
+	}
+	if !d.host || dep.isProcess() {
+		return p, nil
+	}
+	component := dep.Name
+	if index >= 0 {
+		component = replicaName(dep.Name, index)
+	}
+	if d.stack != nil {
+		// the first replica of a dependency with replicas
+		for _, c := range d.stack.snapshot() {
+			if c.Name != component && c.Group != component {
+				continue
+			}
+			for _, k := range []string{p, p + "/tcp", strings.TrimSuffix(p, "/tcp")} {
+				if mapped := c.MappedPorts[k]; mapped != "" {
+					return mapped, nil
+				}
+			}
+			return "", fmt.Errorf("port %s of '%s' is not exposed", p, name)
+		}
+	}
+	return "", fmt.Errorf("dependency '%s' is not started", name)
+}
+
+// Address returns Host:Port of a dependency.
+func (d templateData) Address(name string, port any) (string, error) {
+	host, err := d.Host(name)
+	if err != nil {
+		return "", err
+	}
+	p, err := d.Port(name, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, p), nil
+}
+
+// dependency returns a dependency by name or alias, with the index of the replica when name is the one of
+// a replica, -1 otherwise.
+func (d templateData) dependency(name string) (Dependency, int, bool) {
+	if name == "" {
+		return Dependency{}, -1, false
+	}
+	for _, dep := range d.deps {
+		if dep.Name == name || dep.Alias == name {
+			return dep, -1, true
+		}
+		for i := 0; dep.Replicas > 1 && i < dep.Replicas; i++ {
+			if replicaName(dep.Name, i) == name || dep.Alias != "" && replicaName(dep.Alias, i) == name {
+				return dep, i, true
+			}
+		}
+	}
+	return Dependency{}, -1, false
+}
+
+// GitInfo is the revision of the git repository of the context dir, empty outside a repository.
+// BranchSlug is the Branch usable in an image tag, the characters other than letters, digits, '_', '.' and '-'
+// replaced by '-' (feature/x becomes feature-x).
+type GitInfo struct {
+	Commit      string
+	ShortCommit string
+	Branch      string
+	BranchSlug  string
+}
+
+// gitInfo reads the revision checked out in dir from its .git directory.
+func gitInfo(dir string) (GitInfo, error) {
+	commit, branch, err := utils.GitHead(dir)
+	if err != nil {
+		return GitInfo{}, fmt.Errorf("git: %w", err)
+	}
+	short := commit
+	if len(short) > 12 {
+		short = short[:12]
+	}
+	return GitInfo{Commit: commit, ShortCommit: short, Branch: branch, BranchSlug: branchSlug(branch)}, nil
+}
+
+var nonTagChars = regexp.MustCompile(`[^\w.-]+`)
+
+func branchSlug(branch string) string {
+	return strings.TrimLeft(nonTagChars.ReplaceAllString(branch, "-"), ".-")
+}
+
+// hostEnv returns the environment of gbd as a map.
+func hostEnv() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// renderTemplate renders text as a go template, text without actions is returned as is.
+// A literal {{ is written as {{ "{{" }}.
+func renderTemplate(name, text string, data templateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf(`%w, a literal {{ is written as {{ "{{" }}`, err)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// renderReplacement renders the value of a replacement, or reads it from its Source.
+func renderReplacement(rep Replacement, data templateData) (any, error) {
+	if rep.Source != nil {
+		return data.secret(*rep.Source)
+	}
+	return renderValue(rep.Key, rep.Value, data)
+}
+
+// renderValue renders the strings of a replacement value, including the ones nested in maps and lists.
+func renderValue(name string, v any, data templateData) (any, error) {
+	switch tv := v.(type) {
+	case string:
+		return renderTemplate(name, tv, data)
+	case map[string]any:
+		out := make(map[string]any, len(tv))
+		for k, e := range tv {
+			r, err := renderValue(name, e, data)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(tv))
+		for i, e := range tv {
+			r, err := renderValue(name, e, data)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// renderBuildArgs renders the values of build args, build args without a value are left to the environment.
+func renderBuildArgs(args map[string]*EnvVar, data templateData) (map[string]*string, error) {
+	if args == nil {
+		return nil, nil
+	}
+	out := make(map[string]*string, len(args))
+	for k, v := range args {
+		if v == nil {
+			out[k] = nil
+			continue
+		}
+		r, err := renderEnvVar(k, *v, data)
+		if err != nil {
+			return nil, fmt.Errorf("build arg '%s': %w", k, err)
+		}
+		out[k] = &r
+	}
+	return out, nil
+}
+
+// renderEnv renders the values of a dependency env.
+func renderEnv(env map[string]EnvVar, data templateData) (map[string]string, error) {
+	if env == nil {
+		return nil, nil
+	}
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		r, err := renderEnvVar(k, v, data)
+		if err != nil {
+			return nil, fmt.Errorf("env '%s': %w", k, err)
+		}
+		out[k] = r
+	}
+	return out, nil
+}
+
+// renderEnvVar renders a template value or reads the value of a SecretSource.
+func renderEnvVar(name string, v EnvVar, data templateData) (string, error) {
+	if v.isSet() {
+		return data.secret(v.SecretSource)
+	}
+	return renderTemplate(name, v.Value, data)
+}
@@ -0,0 +1,60 @@
+#!/usr/bin/env bash
+# Generated by gbd
+set -euo pipefail
+
+
+wait_until() {
+  local name=$1 timeout=$2
+  shift 2
+  for _ in $(seq "$timeout"); do
+    if "$@"; then
+      return 0
+    fi
+    sleep 1
+  done
+  echo "$name is not ready after ${timeout}s" >&2
+  exit 1
+}
+
+healthy() {
+  [ "$(docker inspect -f '{{if .State.Health}}{{.State.Health.Status}}{{end}}' "$1" 2>/dev/null)" = "healthy" ]
+}
+
+logged() {
+  docker logs "$1" 2>&1 | grep -q "$2" -- "$3"
+}
+
+DIR="$(cd "$(dirname "$0")" && pwd)"
+
+down() {
+  docker rm -f 'api $(touch pwned)' >/dev/null 2>&1 || true
+  docker rm -f 'db'\''; touch pwned; echo '\''' >/dev/null 2>&1 || true
+  docker network rm 'frontend' >/dev/null 2>&1 || true
+  docker network rm 'backend' >/dev/null 2>&1 || true
+}
+
+if [ "${1:-up}" = "down" ]; then
+  down
+  exit 0
+fi
+
+docker network create 'frontend' >/dev/null
+docker network create 'backend' >/dev/null
+
+# db'; touch pwned; echo '
+docker run -d \
+  --name 'db'\''; touch pwned; echo '\''' \
+  --network 'backend' \
+  --pull missing \
+  'postgres:16' >/dev/null
+wait_until 'db'\''; touch pwned; echo '\''' 60 healthy 'db'\''; touch pwned; echo '\'''
+
+# api $(touch pwned)
+docker create \
+  --name 'api $(touch pwned)' \
+  --network 'frontend' \
+  --pull missing \
+  'api:latest' >/dev/null
+docker network connect 'backend' 'api $(touch pwned)'
+docker start 'api $(touch pwned)' >/dev/null
+wait_until 'api $(touch pwned)' 60 logged 'api $(touch pwned)' -F 'listening on'
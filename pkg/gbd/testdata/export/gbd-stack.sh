@@ -0,0 +1,76 @@
+#!/usr/bin/env bash
+# Generated by gbd
+set -euo pipefail
+
+# UNRESOLVED: cache: port wait strategy has no healthcheck equivalent, dependents only wait for it to start
+# UNRESOLVED: web: http wait strategy has no healthcheck equivalent, dependents only wait for it to start
+
+wait_until() {
+  local name=$1 timeout=$2
+  shift 2
+  for _ in $(seq "$timeout"); do
+    if "$@"; then
+      return 0
+    fi
+    sleep 1
+  done
+  echo "$name is not ready after ${timeout}s" >&2
+  exit 1
+}
+
+healthy() {
+  [ "$(docker inspect -f '{{if .State.Health}}{{.State.Health.Status}}{{end}}' "$1" 2>/dev/null)" = "healthy" ]
+}
+
+logged() {
+  docker logs "$1" 2>&1 | grep -q "$2" -- "$3"
+}
+
+DIR="$(cd "$(dirname "$0")" && pwd)"
+
+down() {
+  docker rm -f 'web' >/dev/null 2>&1 || true
+  docker rm -f 'api' >/dev/null 2>&1 || true
+  docker rm -f 'cache' >/dev/null 2>&1 || true
+  docker rm -f 'db' >/dev/null 2>&1 || true
+  docker network rm 'gbd' >/dev/null 2>&1 || true
+}
+
+if [ "${1:-up}" = "down" ]; then
+  down
+  exit 0
+fi
+
+docker network create 'gbd' >/dev/null
+
+# db
+docker run -d \
+  --name 'db' \
+  --network 'gbd' \
+  --pull missing \
+  -e 'POSTGRES_PASSWORD=root' \
+  'postgres:16' >/dev/null
+wait_until 'db' 60 healthy 'db'
+
+# cache
+docker run -d \
+  --name 'cache' \
+  --network 'gbd' \
+  --pull missing \
+  'redis:7' >/dev/null
+
+# api
+docker run -d \
+  --name 'api' \
+  --network 'gbd' \
+  --pull missing \
+  -p '8080:8080' \
+  'api:latest' >/dev/null
+wait_until 'api' 60 logged 'api' -F 'listening on'
+
+# web
+docker run -d \
+  --name 'web' \
+  --network 'gbd' \
+  --pull missing \
+  'web:latest' >/dev/null
@@ -0,0 +1,151 @@
+package gbd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/PanagiotisGts/gbd/internal/utils"
+)
+
+const (
+	defaultCertPath string = "/etc/gbd/tls/tls.crt"
+	defaultKeyPath  string = "/etc/gbd/tls/tls.key"
+	defaultCAPath   string = "/etc/gbd/tls/ca.crt"
+	caValidity             = 24 * time.Hour
+)
+
+// StackTLS configures the CA of the stack. CAFile exports the CA certificate (relative to the context dir) when the
+// stack is built, so that clients on the host can trust the components.
+type StackTLS struct {
+	CAFile string `yaml:"caFile,omitempty"`
+}
+
+// ComponentTLS requests a certificate issued by the CA of the stack for a dependency. The SANs of the certificate
+// are the alias, the name, localhost and 127.0.0.1 plus SANs. The certificate, its key and the CA certificate
+// are copied into the container at Cert, Key and CA (default /etc/gbd/tls/{tls.crt,tls.key,ca.crt}).
+// KeyMode is the file mode of the key, 0600 by default.
+type ComponentTLS struct {
+	Cert    string   `yaml:"cert,omitempty"`
+	Key     string   `yaml:"key,omitempty"`
+	CA      string   `yaml:"ca,omitempty"`
+	KeyMode int64    `yaml:"keyMode,omitempty"`
+	SANs    []string `yaml:"sans,omitempty"`
+}
+
+// Certificate is an issued certificate as exposed to templates, {{ (index .TLS "<name>").CertPath }}, and to
+// derived values, fromTLS: <name> with propertyName cert, key, ca, certPath, keyPath or caPath.
+type Certificate struct {
+	Cert     string
+	Key      string
+	CA       string
+	CertPath string
+	KeyPath  string
+	CAPath   string
+}
+
+// property returns a field of the certificate by its derived value property name.
+func (c Certificate) property(name string) (string, error) {
+	switch name {
+	case "cert":
+		return c.Cert, nil
+	case "key":
+		return c.Key, nil
+	case "ca":
+		return c.CA, nil
+	case "certPath":
+		return c.CertPath, nil
+	case "keyPath":
+		return c.KeyPath, nil
+	case "caPath":
+		return c.CAPath, nil
+	}
+	return "", fmt.Errorf("unknown tls property '%s'", name)
+}
+
+// files returns the files of the certificate to be copied into the container.
+func (c Certificate) files(spec *ComponentTLS) []memoryFile {
+	keyMode := spec.KeyMode
+	if keyMode == 0 {
+		keyMode = 0600
+	}
+	return []memoryFile{
+		{target: c.CertPath, content: []byte(c.Cert), mode: 0644},
+		{target: c.KeyPath, content: []byte(c.Key), mode: keyMode},
+		{target: c.CAPath, content: []byte(c.CA), mode: 0644},
+	}
+}
+
+// tlsName is the name a certificate of the dependency is looked up by.
+func (d Dependency) tlsName() string {
+	if d.replica != nil {
+		return d.replica.name
+	}
+	if d.Name != "" {
+		return d.Name
+	}
+	return d.Alias
+}
+
+// issueCertificates creates the CA of the stack and issues the certificates of the dependencies which request one.
+// Without any TLS configuration no CA is created and both results are nil.
+func (e *Env) issueCertificates() (*utils.CertificateAuthority, map[string]Certificate, error) {
+	needed := e.TLS != nil
+	for _, dep := range e.Dependencies {
+		needed = needed || dep.TLS != nil
+	}
+	if !needed {
+		return nil, nil, nil
+	}
+
+	ca, err := utils.NewCertificateAuthority("gbd stack CA", caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs := make(map[string]Certificate)
+	for _, dep := range e.Dependencies {
+		if dep.TLS == nil {
+			continue
+		}
+		name := dep.tlsName()
+		if name == "" {
+			return nil, nil, fmt.Errorf("%s: tls requires a name or an alias", dep.Image)
+		}
+		sans := append([]string{dep.Alias, dep.Name, "localhost", "127.0.0.1"}, dep.TLS.SANs...)
+		// the certificate is shared by the replicas
+		for i := 0; dep.Replicas > 1 && i < dep.Replicas; i++ {
+			sans = append(sans, replicaName(dep.Name, i))
+			if dep.Alias != "" {
+				sans = append(sans, replicaName(dep.Alias, i))
+			}
+		}
+		cert, key, err := ca.Issue(name, sans)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		certs[name] = Certificate{
+			Cert:     string(cert),
+			Key:      string(key),
+			CA:       string(ca.CertPEM),
+			CertPath: orDefaultPath(dep.TLS.Cert, defaultCertPath),
+			KeyPath:  orDefaultPath(dep.TLS.Key, defaultKeyPath),
+			CAPath:   orDefaultPath(dep.TLS.CA, defaultCAPath),
+		}
+	}
+	return ca, certs, nil
+}
+
+// writeCAFile writes the CA certificate to tls.caFile. It is only called by Build, exports write their own copy.
+func (e *Env) writeCAFile(ca *utils.CertificateAuthority) error {
+	if ca == nil || e.TLS == nil || e.TLS.CAFile == "" {
+		return nil
+	}
+	return os.WriteFile(e.contextPath(e.TLS.CAFile), ca.CertPEM, 0644)
+}
+
+func orDefaultPath(path, def string) string {
+	if path == "" {
+		return def
+	}
+	return path
+}
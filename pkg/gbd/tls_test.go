@@ -0,0 +1,72 @@
+package gbd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssueCertificates(t *testing.T) {
+	none, certs, err := (&Env{Dependencies: []Dependency{{Name: "db"}}}).issueCertificates()
+	require.NoError(t, err)
+	require.Nil(t, none)
+	require.Nil(t, certs)
+
+	e := &Env{
+		ContextDir: t.TempDir(),
+		TLS:        &StackTLS{CAFile: "ca.pem"},
+		Dependencies: []Dependency{
+			{Name: "db", Alias: "postgres", TLS: &ComponentTLS{Cert: "/certs/server.crt", SANs: []string{"db.local"}}},
+			{Name: "app"},
+		},
+	}
+	ca, certs, err := e.issueCertificates()
+	require.NoError(t, err)
+	require.Len(t, certs, 1)
+
+	// only Build writes the CA file, issuing certificates for an export leaves the context dir untouched
+	_, err = os.Stat(filepath.Join(e.ContextDir, "ca.pem"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, e.writeCAFile(ca))
+	exported, err := os.ReadFile(filepath.Join(e.ContextDir, "ca.pem"))
+	require.NoError(t, err)
+	require.Equal(t, ca.CertPEM, exported)
+
+	cert := certs["db"]
+	require.Equal(t, "/certs/server.crt", cert.CertPath)
+	require.Equal(t, defaultKeyPath, cert.KeyPath)
+	require.Equal(t, string(ca.CertPEM), cert.CA)
+
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(exported))
+	block, _ := pem.Decode([]byte(cert.Cert))
+	require.NotNil(t, block)
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	for _, host := range []string{"db", "postgres", "localhost", "127.0.0.1", "db.local"} {
+		_, err := parsed.Verify(x509.VerifyOptions{DNSName: host, Roots: pool})
+		require.NoError(t, err, host)
+	}
+
+	data := templateData{TLS: certs, CA: string(ca.CertPEM)}
+	v, err := renderTemplate("ssl", `{{ (index .TLS "db").KeyPath }}`, data)
+	require.NoError(t, err)
+	require.Equal(t, defaultKeyPath, v)
+
+	dv, ok := derivedValue(map[string]any{"fromTLS": "db", "propertyName": "caPath"})
+	require.True(t, ok)
+	s := &Stack{data: data}
+	resolved, err := s.resolveDerivedValue("ssl.ca", dv)
+	require.NoError(t, err)
+	require.Equal(t, defaultCAPath, resolved)
+
+	_, err = s.resolveDerivedValue("ssl.ca", &ContainerDerivedValue{FromTLS: "app", ContainerPropertyPath: "cert"})
+	require.Error(t, err)
+
+	_, _, err = (&Env{Dependencies: []Dependency{{Image: "postgres", TLS: &ComponentTLS{}}}}).issueCertificates()
+	require.Error(t, err)
+}
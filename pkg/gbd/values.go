@@ -0,0 +1,203 @@
+package gbd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	passwordChars  string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	passwordSymbol string = "!#%*+-_=.:"
+)
+
+// Value is a shared value generated once per stack, referenced as {{ .Values.<name> }} from env, replaceConfig
+// values and templated files. Types:
+//   - password: Length (default 24) alphanumeric characters, plus symbols when Symbols is set
+//   - uuid: a random (v4) UUID
+//   - hex, base64: Length (default 32) random bytes encoded
+//   - rsa (Bits, default 2048), ed25519: a KeyPair of PEM encoded keys
+type Value struct {
+	Type    string `yaml:"type"`
+	Length  int    `yaml:"length,omitempty"`
+	Bits    int    `yaml:"bits,omitempty"`
+	Symbols bool   `yaml:"symbols,omitempty"`
+}
+
+// KeyPair is a generated key pair, PrivateKey is PKCS #8 and PublicKey PKIX, both PEM encoded.
+type KeyPair struct {
+	PrivateKey string `yaml:"privateKey"`
+	PublicKey  string `yaml:"publicKey"`
+}
+
+func (k KeyPair) String() string {
+	return k.PublicKey
+}
+
+// persistedValue is the form of a generated value in the values file, with the spec it was generated from.
+type persistedValue struct {
+	Spec    Value    `yaml:",inline"`
+	Value   string   `yaml:"value,omitempty"`
+	KeyPair *KeyPair `yaml:"keyPair,omitempty"`
+}
+
+// generateValues generates the values of the Env. When the Env has a values file, values stored there
+// with the same spec are reused and the file is updated, so that reloads keep the same values. Changing the
+// spec of a value, e.g. its length, generates it again.
+func (e *Env) generateValues() (map[string]any, error) {
+	persisted := make(map[string]persistedValue)
+	path := e.valuesFilePath()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(b, &persisted); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	values := make(map[string]any, len(e.Values))
+	for name, spec := range e.Values {
+		if p, ok := persisted[name]; ok && p.Spec == spec {
+			values[name] = p.value()
+			continue
+		}
+		v, err := spec.generate()
+		if err != nil {
+			return nil, fmt.Errorf("value '%s': %w", name, err)
+		}
+		values[name] = v
+		persisted[name] = newPersistedValue(spec, v)
+	}
+
+	if path != "" {
+		b, err := yaml.Marshal(persisted)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (e *Env) valuesFilePath() string {
+	if e.ValuesFile == "" || filepath.IsAbs(e.ValuesFile) {
+		return e.ValuesFile
+	}
+	return e.ContextDir + e.ValuesFile
+}
+
+func (p persistedValue) value() any {
+	if p.KeyPair != nil {
+		return *p.KeyPair
+	}
+	return p.Value
+}
+
+func newPersistedValue(spec Value, v any) persistedValue {
+	if kp, ok := v.(KeyPair); ok {
+		return persistedValue{Spec: spec, KeyPair: &kp}
+	}
+	return persistedValue{Spec: spec, Value: fmt.Sprint(v)}
+}
+
+func (v Value) generate() (any, error) {
+	switch v.Type {
+	case "password":
+		chars := passwordChars
+		if v.Symbols {
+			chars += passwordSymbol
+		}
+		return randomString(orDefault(v.Length, 24), chars)
+	case "uuid":
+		b, err := randomBytes(16)
+		if err != nil {
+			return nil, err
+		}
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	case "hex":
+		b, err := randomBytes(orDefault(v.Length, 32))
+		if err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(b), nil
+	case "base64":
+		b, err := randomBytes(orDefault(v.Length, 32))
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, orDefault(v.Bits, 2048))
+		if err != nil {
+			return nil, err
+		}
+		return newKeyPair(key, &key.PublicKey)
+	case "ed25519":
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newKeyPair(key, pub)
+	}
+	return nil, fmt.Errorf("unknown value type '%s'", v.Type)
+}
+
+func newKeyPair(private, public any) (KeyPair, error) {
+	priv, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	return KeyPair{
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv})),
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})),
+	}, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func randomString(n int, chars string) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(chars)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
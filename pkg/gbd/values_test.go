@@ -0,0 +1,81 @@
+package gbd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateValues(t *testing.T) {
+	e := &Env{
+		ContextDir: t.TempDir() + "/",
+		Values: map[string]Value{
+			"password": {Type: "password", Length: 16},
+			"id":       {Type: "uuid"},
+			"key":      {Type: "hex", Length: 8},
+			"jwt":      {Type: "ed25519"},
+		},
+		ValuesFile: ".gbd_values.yaml",
+	}
+	values, err := e.generateValues()
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile(`^[a-zA-Z0-9]{16}$`), values["password"])
+	require.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), values["id"])
+	require.Len(t, values["key"], 16)
+
+	kp := values["jwt"].(KeyPair)
+	block, _ := pem.Decode([]byte(kp.PrivateKey))
+	require.NotNil(t, block)
+	_, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(e.ContextDir, e.ValuesFile))
+
+	// persisted values are reused, a changed type is regenerated
+	e.Values["key"] = Value{Type: "base64"}
+	again, err := e.generateValues()
+	require.NoError(t, err)
+	require.Equal(t, values["password"], again["password"])
+	require.Equal(t, values["jwt"], again["jwt"])
+	require.NotEqual(t, values["key"], again["key"])
+
+	// so is a value whose length changed
+	e.Values["password"] = Value{Type: "password", Length: 20}
+	longer, err := e.generateValues()
+	require.NoError(t, err)
+	require.Len(t, longer["password"], 20)
+	require.Equal(t, again["id"], longer["id"])
+	require.Equal(t, again["key"], longer["key"])
+
+	_, err = (&Env{Values: map[string]Value{"x": {Type: "unknown"}}}).generateValues()
+	require.Error(t, err)
+}
+
+func TestRenderTemplates(t *testing.T) {
+	data := templateData{Values: map[string]any{"pass": "s3cret", "jwt": KeyPair{PublicKey: "PUB"}}}
+
+	env, err := renderEnv(map[string]EnvVar{"POSTGRES_PASSWORD": {Value: "{{ .Values.pass }}"}, "PLAIN": {Value: "x"}}, data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"POSTGRES_PASSWORD": "s3cret", "PLAIN": "x"}, env)
+
+	v, err := renderValue("db", map[string]any{"url": "postgres://admin:{{ .Values.pass }}@db", "keys": []any{"{{ .Values.jwt.PublicKey }}"}}, data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"url": "postgres://admin:s3cret@db", "keys": []any{"PUB"}}, v)
+
+	_, err = renderEnv(map[string]EnvVar{"X": {Value: "{{ .Values.missing }}"}}, data)
+	require.Error(t, err)
+
+	// literal braces are escaped, unescaped ones that do not parse point at the escape
+	env, err = renderEnv(map[string]EnvVar{"CHART": {Value: `{{ "{{" }}.Release.Name}}-{{ .Values.pass }}`}}, data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"CHART": "{{.Release.Name}}-s3cret"}, env)
+	_, err = renderEnv(map[string]EnvVar{"CHART": {Value: "{{ release name }}"}}, data)
+	require.ErrorContains(t, err, `a literal {{ is written as {{ "{{" }}`)
+
+	s := &Stack{}
+	s.addSecrets(data.Values)
+	require.Equal(t, "password: ******", s.mask("password: s3cret"))
+}